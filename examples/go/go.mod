@@ -1,6 +1,6 @@
 module pathrs-example
 
-go 1.18
+go 1.20
 
 require github.com/openSUSE/libpathrs/go-pathrs v0.0.0
 
@@ -0,0 +1,83 @@
+//go:build linux
+
+/*
+ * libpathrs: safe path resolution on Linux
+ * Copyright (C) 2019-2024 Aleksa Sarai <cyphar@cyphar.com>
+ * Copyright (C) 2019-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pathrs
+
+import (
+	"os"
+	"sync/atomic"
+)
+
+// AuditEvent describes a path operation, and is passed to the hook
+// registered with [SetAuditHook].
+type AuditEvent struct {
+	// Op is the name of the operation (such as "resolve" or "creat"). This
+	// is the same as the Op field of any [Error] returned by the operation.
+	Op string
+	// Path is the path (within the [Root]) that was requested.
+	Path string
+	// ResolvedPath is the path of the resulting file (as given by
+	// /proc/self/fd/$n), if the operation succeeded. See [Handle.Name].
+	ResolvedPath string
+	// Err is the error returned by the operation, if it failed.
+	Err error
+}
+
+var auditHook atomic.Pointer[func(AuditEvent)]
+
+// SetAuditHook registers a hook which is called after every operation that
+// resolves a path to a new file within a [Root] ([Root.Resolve],
+// [Root.ResolveNoFollow], [Root.ResolveMany], [Root.OpenFile], [Root.Create],
+// and [Root.MkdirAllHandle], as well as every helper built on top of them,
+// and [Cursor.Create] and [Cursor.Mkdir]) with a description of the operation
+// and its outcome. This is intended to
+// allow security-sensitive programs to log every path operation.
+//
+// The hook is called synchronously in the goroutine that performed the
+// operation (but not while any locks internal to this package are held), so
+// it should return quickly. Passing nil disables the hook. If no hook is
+// registered, the overhead is a single atomic load per operation.
+func SetAuditHook(fn func(event AuditEvent)) {
+	if fn == nil {
+		auditHook.Store(nil)
+		return
+	}
+	auditHook.Store(&fn)
+}
+
+func audit(op, path string, file *os.File, err error) {
+	hook := auditHook.Load()
+	if hook == nil {
+		return
+	}
+	event := AuditEvent{Op: op, Path: path, Err: err}
+	if file != nil {
+		event.ResolvedPath = file.Name()
+	}
+	(*hook)(event)
+}
+
+func auditHandle(op, path string, handle *Handle, err error) {
+	var file *os.File
+	if handle != nil {
+		file = handle.inner
+	}
+	audit(op, path, file, err)
+}
@@ -0,0 +1,183 @@
+//go:build linux
+
+/*
+ * libpathrs: safe path resolution on Linux
+ * Copyright (C) 2019-2024 Aleksa Sarai <cyphar@cyphar.com>
+ * Copyright (C) 2019-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pathrs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// Cursor is a directory within a [Root] that paths can be resolved relative
+// to, similar to the current working directory of a process. It is created
+// with [Root.At], and all of its methods are built on top of [ResolveAt], so
+// paths used with a Cursor can never escape the Cursor's directory (see
+// [ResolveAt] for how ".." and absolute symlinks are handled).
+//
+// The Cursor holds its own [Handle] to the directory, so it remains usable if
+// the [Root] is closed and must be closed separately with [Cursor.Close].
+type Cursor struct {
+	dir *Handle
+}
+
+// At returns a [Cursor] for the directory at the given path within the
+// [Root]'s directory tree. All symlinks (including trailing symlinks) are
+// followed within the rootfs. If the path is not a directory, an error
+// wrapping ENOTDIR is returned.
+func (r *Root) At(dir string) (*Cursor, error) {
+	handle, err := r.Resolve(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDirHandle("at", handle); err != nil {
+		_ = handle.Close()
+		return nil, err
+	}
+	return &Cursor{dir: handle}, nil
+}
+
+// Handle returns the [Handle] to the [Cursor]'s directory. The [Handle] is
+// owned by the [Cursor] and must not be closed.
+func (c *Cursor) Handle() *Handle {
+	return c.dir
+}
+
+// Resolve is like [Root.Resolve], except that path is resolved relative to
+// the [Cursor]'s directory (using [ResolveAt]).
+func (c *Cursor) Resolve(path string) (*Handle, error) {
+	return ResolveAt(c.dir, path)
+}
+
+// Stat is like [Root.Stat], except that path is resolved relative to the
+// [Cursor]'s directory.
+func (c *Cursor) Stat(path string) (os.FileInfo, error) {
+	handle, err := c.Resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+
+	return handle.Stat()
+}
+
+// Open is like [Root.Open], except that path is resolved relative to the
+// [Cursor]'s directory.
+func (c *Cursor) Open(path string) (*os.File, error) {
+	handle, err := c.Resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+
+	return handle.Open()
+}
+
+// withCursorParent resolves the parent directory of path relative to the
+// [Cursor]'s directory, and calls fn with it and the final component of path.
+func withCursorParent[T any](c *Cursor, op, path string, fn func(dirFd uintptr, name string) (T, error)) (T, error) {
+	dir, name := filepath.Split(strings.TrimRight(path, "/"))
+	if name == "" || name == "." || name == ".." {
+		return *new(T), &Error{
+			Errno:       unix.EINVAL,
+			Op:          op,
+			Path:        path,
+			Description: "path has no final component that can be created",
+		}
+	}
+	if dir == "" {
+		dir = "."
+	}
+
+	parent, err := c.Resolve(dir)
+	if err != nil {
+		return *new(T), err
+	}
+	defer parent.Close()
+
+	if err := checkDirHandle(op, parent); err != nil {
+		return *new(T), err
+	}
+	return withFileFd(parent.inner, func(dirFd uintptr) (T, error) {
+		return fn(dirFd, name)
+	})
+}
+
+// Create is like [Root.Create], except that path is resolved relative to the
+// [Cursor]'s directory. As with [Root.Create], a symlink at the final
+// component of the path is never followed.
+func (c *Cursor) Create(path string, flags int, mode os.FileMode) (*os.File, error) {
+	unixMode, err := toUnixMode(mode)
+	if err != nil {
+		return nil, err
+	}
+	unixMode &^= unix.S_IFMT
+
+	file, err := withCursorParent(c, "creat", path, func(dirFd uintptr, name string) (*os.File, error) {
+		fd, err := unix.Openat(int(dirFd), name, flags|unix.O_CREAT|unix.O_NOFOLLOW|unix.O_CLOEXEC, unixMode)
+		if err != nil {
+			return nil, cursorError(err, "creat", path, "openat(O_CREAT) in parent")
+		}
+		return mkFile(uintptr(fd)), nil
+	})
+	audit("creat", path, file, err)
+	return file, err
+}
+
+// Mkdir is like [Root.Mkdir], except that path is resolved relative to the
+// [Cursor]'s directory. If the path already exists, the returned error wraps
+// EEXIST.
+func (c *Cursor) Mkdir(path string, mode os.FileMode) error {
+	unixMode, err := toUnixMode(mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = withCursorParent(c, "mkdir", path, func(dirFd uintptr, name string) (struct{}, error) {
+		if err := unix.Mkdirat(int(dirFd), name, unixMode); err != nil {
+			return struct{}{}, cursorError(err, "mkdir", path, "mkdirat in parent")
+		}
+		return struct{}{}, nil
+	})
+	audit("mkdir", path, nil, err)
+	return err
+}
+
+// cursorError converts an error from a syscall made by a [Cursor] method into
+// an [Error], matching the errors returned by the equivalent [Root] methods.
+func cursorError(err error, op, path, desc string) error {
+	var errno unix.Errno
+	_ = errors.As(err, &errno)
+	return &Error{
+		Errno:       errno,
+		Op:          op,
+		Path:        path,
+		Description: desc + ": " + err.Error(),
+	}
+}
+
+// Close releases the [Cursor]'s [Handle]. Calling Close more than once
+// returns [ErrClosed].
+func (c *Cursor) Close() error {
+	return c.dir.Close()
+}
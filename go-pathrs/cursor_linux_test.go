@@ -0,0 +1,88 @@
+//go:build linux
+
+/*
+ * libpathrs: safe path resolution on Linux
+ * Copyright (C) 2019-2024 Aleksa Sarai <cyphar@cyphar.com>
+ * Copyright (C) 2019-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pathrs
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/openSUSE/libpathrs/go-pathrs/pathrstest"
+)
+
+func TestCursorCreateMkdir(t *testing.T) {
+	root, _ := testRoot(t, map[string]pathrstest.Entry{
+		"dir/file": {Kind: pathrstest.File},
+	})
+	cursor, err := root.At("dir")
+	if err != nil {
+		t.Fatalf("At: %v", err)
+	}
+	defer cursor.Close()
+
+	var (
+		mu     sync.Mutex
+		events []AuditEvent
+	)
+	SetAuditHook(func(event AuditEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		if event.Op == "creat" || event.Op == "mkdir" {
+			events = append(events, event)
+		}
+	})
+	defer SetAuditHook(nil)
+
+	file, err := cursor.Create("new", unix.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	_ = file.Close()
+	err = cursor.Mkdir("file", 0o755)
+	if !errors.Is(err, unix.EEXIST) {
+		t.Errorf("Mkdir(file) = %v; want EEXIST", err)
+	}
+	var perr *Error
+	if !errors.As(err, &perr) || perr.Op != "mkdir" || perr.Path != "file" {
+		t.Errorf("Mkdir(file) = %#v; want *Error for mkdir of file", err)
+	}
+	_, err = cursor.Create("file", unix.O_WRONLY|unix.O_EXCL, 0o644)
+	if !errors.As(err, &perr) || perr.Op != "creat" || perr.Errno != unix.EEXIST {
+		t.Errorf("Create(file, O_EXCL) = %v; want *Error for creat with EEXIST", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 3 {
+		t.Fatalf("got %d audit events; want 3: %+v", len(events), events)
+	}
+	if events[0].Op != "creat" || events[0].Path != "new" || events[0].Err != nil || events[0].ResolvedPath == "" {
+		t.Errorf("unexpected Create audit event: %+v", events[0])
+	}
+	if events[1].Op != "mkdir" || events[1].Path != "file" || !errors.Is(events[1].Err, unix.EEXIST) {
+		t.Errorf("unexpected Mkdir audit event: %+v", events[1])
+	}
+	if events[2].Op != "creat" || events[2].Err == nil {
+		t.Errorf("unexpected failed Create audit event: %+v", events[2])
+	}
+}
@@ -20,4 +20,13 @@
 
 // Package pathrs provides bindings for libpathrs, a library for safe path
 // resolution on Linux.
+//
+// By default, this package uses cgo to link against libpathrs. For
+// environments where libpathrs is not available (such as static builds
+// without a C toolchain), building with the "nocgo" build tag instead uses a
+// pure-Go implementation based on openat2(2) with RESOLVE_IN_ROOT. The API is
+// identical, but the pure-Go implementation has no fallback resolver (so Linux
+// 5.6 or later is required) and its procfs handling is less hardened than
+// libpathrs's (it does not use fsopen(2) or open_tree(2) to get a private
+// procfs mount).
 package pathrs
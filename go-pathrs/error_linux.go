@@ -21,25 +21,299 @@
 package pathrs
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
 	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
-// Error represents an underlying libpathrs error.
+// ErrUnsupported is returned (wrapped) by operations that are not supported
+// by the running kernel or the filesystem being operated on, such as
+// [Root.LchmodIfSupported] on most filesystems.
+var ErrUnsupported = errors.New("not supported by this kernel or filesystem")
+
+// ErrWouldBlock is returned (wrapped) by [Root.TryLock] if the lock is
+// already held (and so acquiring it would block). The error also wraps
+// EWOULDBLOCK.
+var ErrWouldBlock = errors.New("lock is held elsewhere")
+
+// ErrTooLarge is returned (wrapped) by [Root.ReadFileLimit] if the file is
+// larger than the requested limit.
+var ErrTooLarge = errors.New("file exceeds size limit")
+
+// ErrClosed is returned (wrapped) when operating on a [Root] or [Handle] that
+// has already been closed. It is the same as [os.ErrClosed].
+//
+// [os.ErrClosed]: https://pkg.go.dev/os#ErrClosed
+var ErrClosed = os.ErrClosed
+
+// Error represents an underlying libpathrs error. Errors returned by
+// libpathrs operations are of this type (though they may be wrapped, such as
+// by [SymlinkLoopError]), so you can use [errors.As] to inspect them:
+//
+//	var perr *pathrs.Error
+//	if errors.As(err, &perr) {
+//		log.Printf("%s failed: %s", perr.Op, perr.Description)
+//	}
+//
+// [Error.Unwrap] returns the errno associated with the error (if there is
+// one), so [errors.Is] can be used with [syscall.Errno] values or [fs]
+// sentinel errors such as [fs.ErrNotExist].
+//
+// [errors.As]: https://pkg.go.dev/errors#As
+// [errors.Is]: https://pkg.go.dev/errors#Is
+// [syscall.Errno]: https://pkg.go.dev/syscall#Errno
+// [fs]: https://pkg.go.dev/io/fs
+// [fs.ErrNotExist]: https://pkg.go.dev/io/fs#ErrNotExist
 type Error struct {
-	description string
-	errno       syscall.Errno
+	// Errno is the errno(3) value of the underlying error, or 0 if the
+	// error was not caused by a syscall failure.
+	Errno syscall.Errno
+	// Op is the name of the libpathrs operation which failed (such as
+	// "resolve" or "mkdir_all").
+	Op string
+	// Path is the path argument of the operation (if any). For operations
+	// which take two paths (such as "rename"), this is the source path.
+	Path string
+	// Description is the textual description of the error provided by
+	// libpathrs (or the bindings).
+	Description string
 }
 
 // Error returns a textual description of the error.
 func (err *Error) Error() string {
-	return err.description
+	switch {
+	case err.Op == "":
+		return err.Description
+	case err.Path == "":
+		return err.Op + ": " + err.Description
+	default:
+		return err.Op + " " + err.Path + ": " + err.Description
+	}
 }
 
 // Unwrap returns the underlying error which was wrapped by this error (if
 // applicable).
 func (err *Error) Unwrap() error {
-	if err.errno != 0 {
-		return err.errno
+	if err.Errno != 0 {
+		return err.Errno
 	}
 	return nil
 }
+
+// MarshalJSON encodes the error as a JSON object, for passing error details
+// across API boundaries. The object has the form:
+//
+//	{"errno": 2, "errnoName": "ENOENT", "op": "resolve", "path": "foo", "description": "..."}
+//
+// The "errnoName" field is looked up from the errno value, and is omitted if
+// there is no errno (or it is not a known errno value).
+func (err *Error) MarshalJSON() ([]byte, error) {
+	var errnoName string
+	if err.Errno != 0 {
+		errnoName = unix.ErrnoName(err.Errno)
+	}
+	return json.Marshal(struct {
+		Errno       uintptr `json:"errno"`
+		ErrnoName   string  `json:"errnoName,omitempty"`
+		Op          string  `json:"op"`
+		Path        string  `json:"path"`
+		Description string  `json:"description"`
+	}{
+		Errno:       uintptr(err.Errno),
+		ErrnoName:   errnoName,
+		Op:          err.Op,
+		Path:        err.Path,
+		Description: err.Description,
+	})
+}
+
+// SymlinkLoopError is returned by operations that failed with ELOOP while
+// resolving a path, such as when the path contains a symlink loop or more
+// symlinks than the symlink traversal limit. It wraps the underlying [Error],
+// so [errors.As] can be used to get either type.
+//
+// Note that libpathrs also returns ELOOP for some rejections of symlinks that
+// are not loops (for instance, when a magic-link is found during resolution,
+// or if an O_NOFOLLOW open hits a trailing symlink). [SymlinkLoopError.IsLoop]
+// uses the error description to distinguish these cases where libpathrs
+// provides enough information to do so. Attempts to escape the [Root] (which
+// are rejected with EXDEV) are never reported as a SymlinkLoopError.
+//
+// [errors.As]: https://pkg.go.dev/errors#As
+type SymlinkLoopError struct {
+	// Err is the underlying libpathrs error.
+	Err *Error
+}
+
+// Error returns a textual description of the error.
+func (err *SymlinkLoopError) Error() string {
+	return err.Err.Error()
+}
+
+// Unwrap returns the underlying [Error].
+func (err *SymlinkLoopError) Unwrap() error {
+	return err.Err
+}
+
+// IsLoop returns whether the error was caused by a genuine symlink loop (or
+// exceeding the symlink traversal limit), rather than a restriction on which
+// kinds of symlinks may be followed. If libpathrs did not provide enough
+// information to tell (as is the case with the openat2 resolver), IsLoop
+// returns true.
+func (err *SymlinkLoopError) IsLoop() bool {
+	desc := err.Err.Description
+	return !strings.Contains(desc, "magic-link") &&
+		!strings.Contains(desc, "symlink resolution is disabled")
+}
+
+// ExistError is returned by [Root.Mkdir] when the path already exists, to
+// allow callers to distinguish between an existing directory (which is usually
+// fine for idempotent creation) and an existing non-directory inode. It
+// wraps the underlying [Error] (which has an errno of EEXIST), so
+// [errors.Is] with [fs.ErrExist] still works as expected:
+//
+//	var eerr *pathrs.ExistError
+//	if errors.As(err, &eerr) && eerr.IsDir {
+//		err = nil // the directory already exists
+//	}
+//
+// [errors.Is]: https://pkg.go.dev/errors#Is
+// [fs.ErrExist]: https://pkg.go.dev/io/fs#ErrExist
+type ExistError struct {
+	// Err is the underlying libpathrs error.
+	Err *Error
+	// IsDir is whether the existing inode is a directory. Trailing symlinks
+	// are not followed, so a symlink to a directory is not a directory.
+	IsDir bool
+}
+
+// Error returns a textual description of the error.
+func (err *ExistError) Error() string {
+	return err.Err.Error()
+}
+
+// Unwrap returns the underlying [Error].
+func (err *ExistError) Unwrap() error {
+	return err.Err
+}
+
+// NotDirError is returned by operations on a [Root] that failed with ENOTDIR
+// because one of the components of the path is not a directory. libpathrs
+// does not report which component caused the error, so the bindings work it
+// out by re-resolving the path after the failure (if the offending component
+// cannot be found, such as when the tree was modified in the meantime, the
+// plain [Error] is returned instead). It wraps the underlying [Error], so
+// [errors.As] can be used to get either type:
+//
+//	var nerr *pathrs.NotDirError
+//	if errors.As(err, &nerr) {
+//		log.Printf("%s: %s is not a directory", nerr.Err.Path, path.Base(nerr.Component))
+//	}
+//
+// [errors.As]: https://pkg.go.dev/errors#As
+type NotDirError struct {
+	// Err is the underlying libpathrs error.
+	Err *Error
+	// Component is the leading part of the path (up to and including the
+	// offending component) that is not a directory. For instance, if "foo/bar"
+	// is a regular file then resolving "foo/bar/baz" results in a Component
+	// of "foo/bar".
+	Component string
+}
+
+// Error returns a textual description of the error.
+func (err *NotDirError) Error() string {
+	return err.Err.Error() + " (" + err.Component + " is not a directory)"
+}
+
+// Unwrap returns the underlying [Error].
+func (err *NotDirError) Unwrap() error {
+	return err.Err
+}
+
+// EscapeKind describes why libpathrs rejected an operation because it may
+// have allowed an escape from the [Root] (or from procfs). It is returned by
+// [Error.EscapeKind].
+type EscapeKind int
+
+const (
+	// EscapeNone indicates that the error was not a safety violation.
+	EscapeNone EscapeKind = iota
+	// EscapeDotDot indicates that a ".." component was rejected by the
+	// restricted procfs resolver, because it could not be safely resolved.
+	EscapeDotDot
+	// EscapeAbsoluteSymlink is reserved for rejections of absolute symlinks.
+	// libpathrs currently resolves absolute symlinks relative to the [Root]
+	// (rather than rejecting them), so this is never returned at the moment.
+	EscapeAbsoluteSymlink
+	// EscapeMagicLink indicates that a magic-link (such as /proc/self/root)
+	// was found during resolution and was rejected.
+	EscapeMagicLink
+	// EscapeMountPoint indicates that something was unexpectedly mounted on
+	// the path being resolved (such as an over-mounted /proc).
+	EscapeMountPoint
+	// EscapeRace indicates that libpathrs detected a concurrent change to
+	// the filesystem that may have been an attempt to trick the resolver
+	// (such as a directory being moved outside of the [Root] during
+	// resolution).
+	EscapeRace
+	// EscapeOther indicates a safety violation which does not fall into any
+	// of the other categories.
+	EscapeOther
+)
+
+// String returns a short description of the [EscapeKind].
+func (k EscapeKind) String() string {
+	switch k {
+	case EscapeNone:
+		return "none"
+	case EscapeDotDot:
+		return "dotdot"
+	case EscapeAbsoluteSymlink:
+		return "absolute-symlink"
+	case EscapeMagicLink:
+		return "magic-link"
+	case EscapeMountPoint:
+		return "mount-point"
+	case EscapeRace:
+		return "race"
+	case EscapeOther:
+		return "other"
+	default:
+		return fmt.Sprintf("EscapeKind(%d)", int(k))
+	}
+}
+
+// EscapeKind returns the reason libpathrs rejected the operation as a
+// possible escape, or [EscapeNone] if the error was not caused by a safety
+// violation. Safety violations are reported by libpathrs as EXDEV errors
+// (except for magic-links, which are reported as ELOOP).
+//
+// libpathrs does not provide a machine-readable description of safety
+// violations through its C API, so the reason is derived from the error
+// description. Any EXDEV error which cannot be classified is reported as
+// [EscapeOther]. [EscapeAbsoluteSymlink] is never returned.
+func (err *Error) EscapeKind() EscapeKind {
+	desc := err.Description
+	switch {
+	// A race can be detected while resolving any kind of component, so its
+	// description may also mention "'..'" or a magic-link.
+	case err.Errno == unix.EXDEV && (strings.Contains(desc, "racing") || strings.Contains(desc, "doesn't match expected path")):
+		return EscapeRace
+	case (err.Errno == unix.ELOOP || err.Errno == unix.EXDEV) && strings.Contains(desc, "magic-link"):
+		return EscapeMagicLink
+	case err.Errno != unix.EXDEV:
+		return EscapeNone
+	case strings.Contains(desc, "'..'"):
+		return EscapeDotDot
+	case strings.Contains(desc, "procfs mount"), strings.Contains(desc, "fstype mismatch"):
+		return EscapeMountPoint
+	default:
+		return EscapeOther
+	}
+}
@@ -0,0 +1,53 @@
+//go:build linux
+
+/*
+ * libpathrs: safe path resolution on Linux
+ * Copyright (C) 2019-2024 Aleksa Sarai <cyphar@cyphar.com>
+ * Copyright (C) 2019-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pathrs
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestErrorEscapeKind(t *testing.T) {
+	for _, test := range []struct {
+		errno unix.Errno
+		desc  string
+		want  EscapeKind
+	}{
+		{unix.ENOENT, "no such file or directory", EscapeNone},
+		// MkdirAll rejects '..' in the yet-to-be-created part of the path
+		// with ENOENT, which is not a safety violation.
+		{unix.ENOENT, "yet-to-be-created path contains '..' components", EscapeNone},
+		{unix.EXDEV, "'..' is not allowed in procfs", EscapeDotDot},
+		{unix.ELOOP, "refusing to follow magic-link", EscapeMagicLink},
+		{unix.EXDEV, "magic-link found", EscapeMagicLink},
+		{unix.EXDEV, "procfs mount is not the root of the filesystem", EscapeMountPoint},
+		{unix.EXDEV, "fstype mismatch", EscapeMountPoint},
+		{unix.EXDEV, "'..' component racing with a rename", EscapeRace},
+		{unix.EXDEV, "magic-link doesn't match expected path", EscapeRace},
+		{unix.EXDEV, "something else", EscapeOther},
+	} {
+		err := &Error{Errno: test.errno, Op: "resolve", Description: test.desc}
+		if got := err.EscapeKind(); got != test.want {
+			t.Errorf("EscapeKind(%v, %q) = %v; want %v", test.errno, test.desc, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+//go:build linux
+
+/*
+ * libpathrs: safe path resolution on Linux
+ * Copyright (C) 2019-2024 Aleksa Sarai <cyphar@cyphar.com>
+ * Copyright (C) 2019-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pathrs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+
+	"golang.org/x/sys/unix"
+)
+
+// rootFS is an [fs.FS] implementation backed by a [Root].
+//
+// [fs.FS]: https://pkg.go.dev/io/fs#FS
+type rootFS struct {
+	root *Root
+}
+
+var (
+	_ fs.FS         = rootFS{}
+	_ fs.StatFS     = rootFS{}
+	_ fs.ReadDirFS  = rootFS{}
+	_ fs.ReadFileFS = rootFS{}
+)
+
+// FS returns an [fs.FS] view of the [Root]'s directory tree, which also
+// implements [fs.StatFS], [fs.ReadDirFS], [fs.ReadFileFS], and (on Go 1.25
+// and later) [fs.ReadLinkFS]. All of the
+// operations on the returned [fs.FS] are done through libpathrs, so symlinks
+// (even ones with absolute targets or too many ".." components) are always
+// resolved inside the [Root].
+//
+// Names passed to the returned [fs.FS] must be valid according to
+// [fs.ValidPath], so absolute paths and paths containing ".." components are
+// rejected with [fs.ErrInvalid]. The name "." refers to the [Root] itself.
+//
+// The returned [fs.FS] is only valid as long as the [Root] has not been
+// closed.
+//
+// [fs.FS]: https://pkg.go.dev/io/fs#FS
+// [fs.StatFS]: https://pkg.go.dev/io/fs#StatFS
+// [fs.ReadDirFS]: https://pkg.go.dev/io/fs#ReadDirFS
+// [fs.ReadFileFS]: https://pkg.go.dev/io/fs#ReadFileFS
+// [fs.ReadLinkFS]: https://pkg.go.dev/io/fs#ReadLinkFS
+// [fs.ValidPath]: https://pkg.go.dev/io/fs#ValidPath
+// [fs.ErrInvalid]: https://pkg.go.dev/io/fs#ErrInvalid
+func (r *Root) FS() fs.FS {
+	return rootFS{root: r}
+}
+
+func (rfs rootFS) open(op, name string, flags int) (*os.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	file, err := rfs.root.OpenFile(name, flags, 0)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	return file, nil
+}
+
+// Open implements [fs.FS].
+//
+// [fs.FS]: https://pkg.go.dev/io/fs#FS
+func (rfs rootFS) Open(name string) (fs.File, error) {
+	return rfs.open("open", name, os.O_RDONLY)
+}
+
+// Stat implements [fs.StatFS].
+//
+// [fs.StatFS]: https://pkg.go.dev/io/fs#StatFS
+func (rfs rootFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	info, err := rfs.root.Stat(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return info, nil
+}
+
+// ReadDir implements [fs.ReadDirFS]. The returned entries are sorted by
+// filename.
+//
+// [fs.ReadDirFS]: https://pkg.go.dev/io/fs#ReadDirFS
+func (rfs rootFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	dir, err := rfs.open("readdir", name, os.O_RDONLY|unix.O_DIRECTORY)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	entries, err := dir.ReadDir(-1)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	if err != nil {
+		return entries, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return entries, nil
+}
+
+// ReadFile implements [fs.ReadFileFS].
+//
+// [fs.ReadFileFS]: https://pkg.go.dev/io/fs#ReadFileFS
+func (rfs rootFS) ReadFile(name string) ([]byte, error) {
+	file, err := rfs.open("read", name, os.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return data, nil
+}
+
+// ReadLink implements [fs.ReadLinkFS]. The target of the symlink is returned
+// verbatim, without being resolved.
+//
+// [fs.ReadLinkFS]: https://pkg.go.dev/io/fs#ReadLinkFS
+func (rfs rootFS) ReadLink(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	target, err := rfs.root.Readlink(name)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	return target, nil
+}
+
+// Lstat implements [fs.ReadLinkFS]. If name refers to a symlink, the returned
+// [fs.FileInfo] describes the symlink itself.
+//
+// [fs.ReadLinkFS]: https://pkg.go.dev/io/fs#ReadLinkFS
+// [fs.FileInfo]: https://pkg.go.dev/io/fs#FileInfo
+func (rfs rootFS) Lstat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: fs.ErrInvalid}
+	}
+	info, err := rfs.root.Lstat(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "lstat", Path: name, Err: err}
+	}
+	return info, nil
+}
@@ -0,0 +1,127 @@
+//go:build linux
+
+/*
+ * libpathrs: safe path resolution on Linux
+ * Copyright (C) 2019-2024 Aleksa Sarai <cyphar@cyphar.com>
+ * Copyright (C) 2019-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pathrs
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/fstest"
+
+	"github.com/openSUSE/libpathrs/go-pathrs/pathrstest"
+)
+
+func TestFSWalkDirEscapingSymlinks(t *testing.T) {
+	outside := t.TempDir()
+	if err := pathrstest.BuildTree(outside, map[string]pathrstest.Entry{
+		"secret/file": {Kind: pathrstest.File, Data: []byte("secret")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	root, _ := testRoot(t, map[string]pathrstest.Entry{
+		"dir/file":     {Kind: pathrstest.File, Data: []byte("inside")},
+		"dir/abs":      {Kind: pathrstest.Symlink, Target: filepath.Join(outside, "secret")},
+		"dir/dotdot":   {Kind: pathrstest.Symlink, Target: "../../../../../../../../" + outside + "/secret"},
+		"dir/etc":      {Kind: pathrstest.Symlink, Target: "/etc"},
+		"dir/inside":   {Kind: pathrstest.Symlink, Target: "/dir"},
+		"empty":        {Kind: pathrstest.Dir},
+		"top-level-up": {Kind: pathrstest.Symlink, Target: ".."},
+	})
+	fsys := root.FS()
+
+	var walked []string
+	err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		walked = append(walked, path)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WalkDir: %v", err)
+	}
+	// WalkDir must not descend into any of the symlinks, and nothing from
+	// outside the root can show up.
+	want := []string{
+		".",
+		"dir",
+		"dir/abs",
+		"dir/dotdot",
+		"dir/etc",
+		"dir/file",
+		"dir/inside",
+		"empty",
+		"top-level-up",
+	}
+	if !reflect.DeepEqual(walked, want) {
+		t.Errorf("WalkDir visited %q; want %q", walked, want)
+	}
+
+	// Following the escaping symlinks explicitly stays inside the root, where
+	// the targets don't exist.
+	for _, name := range []string{"dir/abs/file", "dir/dotdot/file"} {
+		data, err := fs.ReadFile(fsys, name)
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("ReadFile(%q) = %q, %v; want ErrNotExist", name, data, err)
+		}
+	}
+	// ".." at the top of the root is the root itself.
+	entries, err := fs.ReadDir(fsys, "top-level-up")
+	if err != nil || len(entries) != 3 {
+		t.Errorf("ReadDir(top-level-up) = %d entries, %v; want the 3 entries of the root", len(entries), err)
+	}
+	// In-root symlinks still work.
+	data, err := fs.ReadFile(fsys, "dir/inside/file")
+	if err != nil || string(data) != "inside" {
+		t.Errorf("ReadFile(dir/inside/file) = %q, %v; want %q", data, err, "inside")
+	}
+}
+
+func TestFSInvalidPaths(t *testing.T) {
+	root, _ := testRoot(t, map[string]pathrstest.Entry{
+		"file": {Kind: pathrstest.File},
+	})
+	fsys := root.FS()
+
+	for _, name := range []string{"/file", "../file", "a/../file", "file/", ""} {
+		if _, err := fs.Stat(fsys, name); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("Stat(%q) = %v; want ErrInvalid", name, err)
+		}
+	}
+	if _, err := fs.Stat(fsys, "."); err != nil {
+		t.Errorf("Stat(.) = %v", err)
+	}
+}
+
+func TestFSConformance(t *testing.T) {
+	root, _ := testRoot(t, map[string]pathrstest.Entry{
+		"dir/file":  {Kind: pathrstest.File, Data: []byte("contents")},
+		"dir/empty": {Kind: pathrstest.Dir},
+		"file":      {Kind: pathrstest.File},
+	})
+
+	if err := fstest.TestFS(root.FS(), "dir/file", "dir/empty", "file"); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,5 +1,5 @@
 module github.com/openSUSE/libpathrs/go-pathrs
 
-go 1.18
+go 1.20
 
 require golang.org/x/sys v0.26.0
@@ -21,8 +21,17 @@
 package pathrs
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
 )
 
 // Handle is a handle for a path within a given [Root]. This handle references
@@ -34,27 +43,60 @@ import (
 // you can try to use [Root.Open] or [Root.OpenFile].
 //
 // It is critical that perform all relevant operations through this [Handle]
-// (rather than fetching the file descriptor yourself with [Handle.IntoRaw]),
+// (rather than fetching the file descriptor yourself with [Handle.IntoFile]),
 // because the security properties of libpathrs depend on users doing all
 // relevant filesystem operations through libpathrs.
 //
+// As with [Root], it is safe to call [Handle.Close] while other operations on
+// the [Handle] are in-flight (with the exception of [Handle.ReadDir],
+// [Handle.Read], and [Handle.Write]), and operations started after
+// [Handle.Close] fail with an error wrapping [ErrClosed].
+//
 // [os.File]: https://pkg.go.dev/os#File
 type Handle struct {
 	inner *os.File
+	// dir is a lazily-opened O_RDONLY|O_DIRECTORY copy of inner, used by
+	// ReadDir to keep track of the directory offset between calls.
+	dir *os.File
+	// reader and writer are lazily-opened O_RDONLY and O_WRONLY copies of
+	// inner, used by Read and Write respectively.
+	reader *os.File
+	writer *os.File
+	closed atomic.Bool
+	// closeHooks are called when the Handle is closed (such as to evict
+	// entries for the Handle from a ReopenCache).
+	hookMu     sync.Mutex
+	closeHooks map[any]func()
 }
 
 // HandleFromFile creates a new [Handle] from an existing file handle. The
 // handle will be copied by this method, so the original handle should still be
 // freed by the caller.
 //
-// This is effectively the inverse operation of [Handle.IntoRaw], and is used
-// for "deserialising" pathrs root handles.
+// This is effectively the inverse operation of [Handle.IntoFile], and is used
+// for "deserialising" pathrs handles.
 func HandleFromFile(file *os.File) (*Handle, error) {
 	newFile, err := dupFile(file)
 	if err != nil {
 		return nil, fmt.Errorf("duplicate handle fd: %w", err)
 	}
-	return &Handle{inner: newFile}, nil
+	return newHandle(newFile), nil
+}
+
+// HandleFromFd creates a new [Handle] which takes ownership of the given file
+// descriptor, such as one received from another process with SCM_RIGHTS (see
+// [Handle.Fd]). The file descriptor is closed when the [Handle] is closed.
+//
+// The file descriptor is checked with fstat(2) to make sure it references an
+// inode. If it does not (or is not a valid file descriptor), an error is
+// returned and ownership of the file descriptor is not taken (it is not
+// closed).
+func HandleFromFd(fd uintptr) (*Handle, error) {
+	var stat unix.Stat_t
+	if err := unix.Fstat(int(fd), &stat); err != nil {
+		return nil, fmt.Errorf("fstat handle fd %d: %w", fd, err)
+	}
+	return newHandle(mkFile(fd)), nil
 }
 
 // Open creates an "upgraded" file handle to the file referenced by the
@@ -62,22 +104,31 @@ func HandleFromFile(file *os.File) (*Handle, error) {
 // and can be opened multiple times.
 //
 // The handle returned is only usable for reading, and this is method is
-// shorthand for [Handle.OpenFile] with os.O_RDONLY.
-//
-// TODO: Rename these to "Reopen" or something.
+// shorthand for [Handle.Reopen] with os.O_RDONLY.
 func (h *Handle) Open() (*os.File, error) {
-	return h.OpenFile(os.O_RDONLY)
+	return h.Reopen(os.O_RDONLY)
 }
 
-// OpenFile creates an "upgraded" file handle to the file referenced by the
+// Reopen creates an "upgraded" file handle to the file referenced by the
 // [Handle]. Note that the original [Handle] is not consumed by this operation,
 // and can be opened multiple times.
 //
 // The provided flags indicate which open(2) flags are used to create the new
-// handle.
+// handle (such as os.O_RDWR or os.O_APPEND). Because the file already exists,
+// flags which only make sense when creating a new inode (os.O_CREAT,
+// os.O_EXCL, and O_TMPFILE) are rejected with EINVAL. The returned
+// [os.File] has the same name as the [Handle].
 //
-// TODO: Rename these to "Reopen" or something.
-func (h *Handle) OpenFile(flags int) (*os.File, error) {
+// [os.File]: https://pkg.go.dev/os#File
+func (h *Handle) Reopen(flags int) (*os.File, error) {
+	if flags&(unix.O_CREAT|unix.O_EXCL) != 0 ||
+		flags&unix.O_TMPFILE == unix.O_TMPFILE {
+		return nil, &Error{
+			Errno:       unix.EINVAL,
+			Op:          "reopen",
+			Description: "inode creation flags are not supported when reopening a handle",
+		}
+	}
 	return withFileFd(h.inner, func(fd uintptr) (*os.File, error) {
 		newFd, err := pathrsReopen(fd, flags)
 		if err != nil {
@@ -87,11 +138,285 @@ func (h *Handle) OpenFile(flags int) (*os.File, error) {
 	})
 }
 
+// ReopenContext is identical to [Handle.Reopen], except that the operation is
+// abandoned if ctx is cancelled before it completes (in which case ctx.Err()
+// is returned). If ctx has already been cancelled, the file is not opened at
+// all. This is mostly useful for inodes where open(2) can block indefinitely,
+// such as opening a FIFO for writing when there is no reader.
+//
+// As with [Root.ResolveContext], the blocked open(2) itself cannot be
+// interrupted and continues in the background. If it eventually succeeds, the
+// resulting file is closed automatically. If it never returns (such as a FIFO
+// that is never opened by a reader), the background goroutine is never
+// cleaned up either -- callers that want to avoid this for FIFOs should use
+// [Handle.Reopen] with O_NONBLOCK instead.
+func (h *Handle) ReopenContext(ctx context.Context, flags int) (*os.File, error) {
+	return withContext(ctx, func() (*os.File, error) {
+		return h.Reopen(flags)
+	}, func(f *os.File) { _ = f.Close() })
+}
+
+// OpenFile is an alias for [Handle.Reopen].
+//
+// Deprecated: Use [Handle.Reopen] instead.
+func (h *Handle) OpenFile(flags int) (*os.File, error) {
+	return h.Reopen(flags)
+}
+
+// Name returns the name of the [Handle]. This is the path of the file
+// referenced by the [Handle] at the time the [Handle] was created (as given by
+// /proc/self/fd/$n), or a placeholder if procfs could not be used to get the
+// path. The name does not change if the file is later moved.
+//
+// The name is only informational (useful for logging, for instance). It must
+// not be used to re-open the file, as that would bypass the safety provided by
+// libpathrs.
+func (h *Handle) Name() string {
+	return h.inner.Name()
+}
+
+// Stat returns the [os.FileInfo] describing the file referenced by the
+// [Handle]. This is implemented with fstat(2) on the underlying file
+// descriptor, which works even for O_PATH handles (including handles to
+// symlinks returned by [Root.ResolveNoFollow], in which case the symlink
+// itself is described). The Sys method of the returned [os.FileInfo] returns
+// a *[syscall.Stat_t].
+//
+// [os.FileInfo]: https://pkg.go.dev/os#FileInfo
+// [syscall.Stat_t]: https://pkg.go.dev/syscall#Stat_t
+func (h *Handle) Stat() (os.FileInfo, error) {
+	return h.inner.Stat()
+}
+
+func (h *Handle) sync(flags int, syncFn func(fd int) error, name string) error {
+	// fsync(2) does not work on O_PATH file descriptors, but works on
+	// read-only file descriptors (including directories).
+	file, err := h.Reopen(flags)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = withFileFd(file, func(fd uintptr) (struct{}, error) {
+		if err := syncFn(int(fd)); err != nil {
+			return struct{}{}, fmt.Errorf("%s %s: %w", name, h.Name(), err)
+		}
+		return struct{}{}, nil
+	})
+	return err
+}
+
+// Sync commits the contents and metadata of the file referenced by the
+// [Handle] to stable storage, using fsync(2). Because [Handle]s are O_PATH
+// file descriptors (which cannot be synced), the [Handle] is re-opened with
+// O_RDONLY first.
+//
+// This is effectively equivalent to [os.File.Sync].
+//
+// [os.File.Sync]: https://pkg.go.dev/os#File.Sync
+func (h *Handle) Sync() error {
+	return h.sync(os.O_RDONLY, unix.Fsync, "fsync")
+}
+
+// Datasync is identical to [Handle.Sync], except that it uses fdatasync(2)
+// and so metadata that is not needed to read the file contents (such as the
+// modification time) may not be synced.
+func (h *Handle) Datasync() error {
+	return h.sync(os.O_RDONLY, unix.Fdatasync, "fdatasync")
+}
+
+// Readlink returns the target of the symlink referenced by the [Handle] (such
+// as a [Handle] to a symlink returned by [Root.ResolveNoFollow]). If the
+// [Handle] does not reference a symlink, an error wrapping EINVAL is returned.
+//
+// As with [Root.Readlink], the returned target is the raw contents of the
+// symlink, so it must not be used for further lookups outside of libpathrs.
+func (h *Handle) Readlink() (string, error) {
+	info, err := h.Stat()
+	if err != nil {
+		return "", err
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return "", &Error{
+			Errno:       unix.EINVAL,
+			Op:          "readlink",
+			Path:        h.inner.Name(),
+			Description: "handle does not reference a symlink",
+		}
+	}
+
+	return withFileFd(h.inner, func(fd uintptr) (string, error) {
+		var buf []byte
+		target, err := readlinkatBuf(fd, "", &buf)
+		if err != nil {
+			return "", fmt.Errorf("readlinkat(AT_EMPTY_PATH): %w", err)
+		}
+		return target, nil
+	})
+}
+
+// Truncate changes the size of the file referenced by the [Handle], as with
+// ftruncate(2). Because [Handle]s are O_PATH file descriptors, the [Handle] is
+// first re-opened with O_WRONLY (and the temporary file is closed before
+// Truncate returns, even if the truncation fails). This means truncating a
+// directory returns an error wrapping EISDIR.
+//
+// A negative size results in an error wrapping EINVAL being returned without
+// re-opening the [Handle].
+//
+// This is effectively equivalent to [os.File.Truncate].
+//
+// [os.File.Truncate]: https://pkg.go.dev/os#File.Truncate
+func (h *Handle) Truncate(size int64) error {
+	if size < 0 {
+		return &Error{
+			Errno:       unix.EINVAL,
+			Op:          "truncate",
+			Path:        h.inner.Name(),
+			Description: "cannot truncate file to negative size",
+		}
+	}
+
+	file, err := h.Reopen(os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Truncate(size)
+}
+
+// ReadDir reads the contents of the directory referenced by the [Handle] and
+// returns a slice of up to n [os.DirEntry] values, in directory order. The
+// Info method of each entry lstats the entry relative to the directory (so
+// the entries are never resolved through symlinks).
+//
+// The semantics of n are identical to [os.File.ReadDir]: if n > 0, at most n
+// entries are returned and io.EOF is returned once the directory has been
+// exhausted; if n <= 0, all remaining entries are returned with a nil error.
+// Subsequent calls continue from where the previous call left off.
+//
+// To keep track of the directory offset, the [Handle] is re-opened (as
+// O_RDONLY|O_DIRECTORY) on the first call, and this copy is closed by
+// [Handle.Close]. ReadDir is not safe to call concurrently.
+//
+// [os.DirEntry]: https://pkg.go.dev/os#DirEntry
+// [os.File.ReadDir]: https://pkg.go.dev/os#File.ReadDir
+func (h *Handle) ReadDir(n int) ([]os.DirEntry, error) {
+	if h.dir == nil {
+		dir, err := h.Reopen(os.O_RDONLY | unix.O_DIRECTORY)
+		if err != nil {
+			return nil, err
+		}
+		h.dir = dir
+	}
+	return h.dir.ReadDir(n)
+}
+
+// Read reads up to len(b) bytes from the file referenced by the [Handle],
+// implementing [io.Reader]. On the first call, the [Handle] is re-opened (as
+// O_RDONLY) and this copy is used for all subsequent calls to Read (so the
+// file offset is maintained between calls) until it is closed by
+// [Handle.Close].
+//
+// Read and [Handle.Write] use separate file descriptors, and so they each
+// have their own file offset. Like [Handle.ReadDir], Read is not safe to call
+// concurrently.
+//
+// [io.Reader]: https://pkg.go.dev/io#Reader
+func (h *Handle) Read(b []byte) (int, error) {
+	if h.reader == nil {
+		reader, err := h.Reopen(os.O_RDONLY)
+		if err != nil {
+			return 0, err
+		}
+		h.reader = reader
+	}
+	return h.reader.Read(b)
+}
+
+// Write writes len(b) bytes to the file referenced by the [Handle],
+// implementing [io.Writer]. On the first call, the [Handle] is re-opened (as
+// O_WRONLY) and this copy is used for all subsequent calls to Write until it
+// is closed by [Handle.Close]. See [Handle.Read] for more details.
+//
+// [io.Writer]: https://pkg.go.dev/io#Writer
+func (h *Handle) Write(b []byte) (int, error) {
+	if h.writer == nil {
+		writer, err := h.Reopen(os.O_WRONLY)
+		if err != nil {
+			return 0, err
+		}
+		h.writer = writer
+	}
+	return h.writer.Write(b)
+}
+
+// WithFd calls fn with the [Handle]'s file descriptor (an O_PATH file
+// descriptor, unless the [Handle] came from [Root.CreateTemp]). This is the
+// supported way of doing operations on a [Handle] that are not wrapped by
+// libpathrs (such as ioctl(2) or fgetxattr(2) on a re-opened copy), without
+// the lifetime issues of [Handle.IntoFile].
+//
+// The file descriptor is guaranteed to remain valid until fn returns (even if
+// [Handle.Close] is called concurrently), but fn must not close it or use it
+// after returning. If the [Handle] has already been closed, fn is not called
+// and an error wrapping [ErrClosed] is returned. Otherwise, the error
+// returned by fn is returned.
+func (h *Handle) WithFd(fn func(fd uintptr) error) error {
+	_, err := withFileFd(h.inner, func(fd uintptr) (struct{}, error) {
+		return struct{}{}, fn(fd)
+	})
+	runtime.KeepAlive(h)
+	return err
+}
+
+// Fd returns the file descriptor of the [Handle], without transferring
+// ownership of it. The file descriptor is only valid until [Handle.Close] is
+// called (after which it may be re-used for an unrelated file), so callers
+// must make sure the [Handle] is kept alive (such as with
+// [runtime.KeepAlive]) for as long as the file descriptor is being used.
+// Where possible, [Handle.WithFd] should be used instead.
+//
+// The main use of Fd is passing a [Handle] to another process over a unix
+// socket with SCM_RIGHTS, in which case the receiving process gets its own
+// copy of the file descriptor and can adopt it with [HandleFromFd]:
+//
+//	// sender
+//	rights := unix.UnixRights(int(handle.Fd()))
+//	err := unix.Sendmsg(sock, nil, rights, nil, 0)
+//	runtime.KeepAlive(handle)
+//
+//	// receiver
+//	msgs, _ := unix.ParseSocketControlMessage(oob[:oobn])
+//	fds, _ := unix.ParseUnixRights(&msgs[0])
+//	handle, err := pathrs.HandleFromFd(uintptr(fds[0]))
+//
+// Unlike [os.File.Fd], this does not change the file descriptor to blocking
+// mode.
+//
+// [runtime.KeepAlive]: https://pkg.go.dev/runtime#KeepAlive
+// [os.File.Fd]: https://pkg.go.dev/os#File.Fd
+func (h *Handle) Fd() uintptr {
+	fd, err := withFileFd(h.inner, func(fd uintptr) (uintptr, error) {
+		return fd, nil
+	})
+	if err != nil {
+		// Match os.File.Fd for closed files.
+		return ^uintptr(0)
+	}
+	return fd
+}
+
 // IntoFile unwraps the [Handle] into its underlying [os.File].
 //
-// You almost certainly want to use [Handle.OpenFile] to get a non-O_PATH
+// You almost certainly want to use [Handle.Reopen] to get a non-O_PATH
 // version of this [Handle].
 //
+// It is critical that you do not operate on this file descriptor yourself,
+// because the security properties of libpathrs depend on users doing all
+// relevant filesystem operations through libpathrs.
+//
 // This operation returns the internal [os.File] of the [Handle] directly, so
 // calling [Handle.Close] will also close any copies of the returned [os.File].
 // If you want to get an independent copy, use [Handle.Clone] followed by
@@ -103,16 +428,104 @@ func (h *Handle) IntoFile() *os.File {
 	// TODO: We almost certainly want to clear r.inner here, but we can't do
 	//       that easily atomically (we could use atomic.Value but that'll make
 	//       things quite a bit uglier).
+
+	// The caller now owns the file, so we must not close it if the Handle
+	// gets garbage collected.
+	runtime.SetFinalizer(h, nil)
 	return h.inner
 }
 
 // Clone creates a copy of a [Handle], such that it has a separate lifetime to
-// the original (while referring to the same underlying file).
+// the original (while referring to the same underlying file). This is
+// equivalent to calling [HandleFromFile] with the [Handle]'s underlying file.
 func (h *Handle) Clone() (*Handle, error) {
 	return HandleFromFile(h.inner)
 }
 
-// Close frees all of the resources used by the [Handle].
+// CloneWithCloexec is identical to [Handle.Clone], except that cloexec
+// controls whether the new file descriptor is close-on-exec. See
+// [Root.CloneWithCloexec] for the risks of inheritable file descriptors.
+func (h *Handle) CloneWithCloexec(cloexec bool) (*Handle, error) {
+	newFile, err := dupFileCloexec(h.inner, cloexec)
+	if err != nil {
+		return nil, fmt.Errorf("duplicate handle fd: %w", err)
+	}
+	return newHandle(newFile), nil
+}
+
+// Close frees all of the resources used by the [Handle]. Calling Close more
+// than once returns [ErrClosed]. Calling Close on a nil [Handle] (such as after
+// a failed [Root.Resolve]) does nothing and returns nil.
 func (h *Handle) Close() error {
+	if h == nil {
+		return nil
+	}
+	if !h.closed.CompareAndSwap(false, true) {
+		return ErrClosed
+	}
+	runtime.SetFinalizer(h, nil)
+
+	h.hookMu.Lock()
+	hooks := h.closeHooks
+	h.closeHooks = nil
+	h.hookMu.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
+
+	for _, file := range []*os.File{h.dir, h.reader, h.writer} {
+		if file != nil {
+			_ = file.Close()
+		}
+	}
 	return h.inner.Close()
 }
+
+// CloseAll closes each of the given closers (such as [Handle]s, [Root]s, or
+// [os.File]s), continuing past any failures, and returns all of the errors
+// joined with [errors.Join]. nil closers (including nil pointers such as a
+// nil *[Handle] or *[os.File]) are skipped. This is useful for cleaning up a
+// batch of handles in a single defer.
+//
+// [os.File]: https://pkg.go.dev/os#File
+// [errors.Join]: https://pkg.go.dev/errors#Join
+func CloseAll(closers ...io.Closer) error {
+	var errs []error
+	for _, closer := range closers {
+		if closer == nil {
+			continue
+		}
+		if v := reflect.ValueOf(closer); v.Kind() == reflect.Pointer && v.IsNil() {
+			continue
+		}
+		if err := closer.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// addCloseHook registers fn to be called when the [Handle] is closed. Only one
+// hook can be registered for each key. If the [Handle] has already been
+// closed, fn is not registered and false is returned.
+func (h *Handle) addCloseHook(key any, fn func()) bool {
+	h.hookMu.Lock()
+	defer h.hookMu.Unlock()
+
+	if h.closed.Load() {
+		return false
+	}
+	if h.closeHooks == nil {
+		h.closeHooks = make(map[any]func())
+	}
+	h.closeHooks[key] = fn
+	return true
+}
+
+// removeCloseHook unregisters the hook registered with key (if any).
+func (h *Handle) removeCloseHook(key any) {
+	h.hookMu.Lock()
+	defer h.hookMu.Unlock()
+
+	delete(h.closeHooks, key)
+}
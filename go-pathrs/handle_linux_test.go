@@ -0,0 +1,66 @@
+//go:build linux
+
+/*
+ * libpathrs: safe path resolution on Linux
+ * Copyright (C) 2019-2024 Aleksa Sarai <cyphar@cyphar.com>
+ * Copyright (C) 2019-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pathrs
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestCloseAllNil(t *testing.T) {
+	var (
+		handle *Handle
+		root   *Root
+		file   *os.File
+	)
+	if err := CloseAll(handle, root, file, nil); err != nil {
+		t.Errorf("CloseAll(nil closers) = %v; want nil", err)
+	}
+	if err := handle.Close(); err != nil {
+		t.Errorf("(*Handle)(nil).Close() = %v; want nil", err)
+	}
+	if err := root.Close(); err != nil {
+		t.Errorf("(*Root)(nil).Close() = %v; want nil", err)
+	}
+}
+
+func TestCloseAll(t *testing.T) {
+	root, _ := testRoot(t, nil)
+	handle, err := root.Resolve(".")
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	clone, err := root.Clone()
+	if err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+
+	var missing *Handle
+	if err := CloseAll(handle, missing, clone); err != nil {
+		t.Errorf("CloseAll = %v; want nil", err)
+	}
+	// Closing again reports ErrClosed for each closer.
+	err = CloseAll(handle, clone)
+	if !errors.Is(err, ErrClosed) {
+		t.Errorf("second CloseAll = %v; want ErrClosed", err)
+	}
+}
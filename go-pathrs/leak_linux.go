@@ -0,0 +1,65 @@
+//go:build linux
+
+/*
+ * libpathrs: safe path resolution on Linux
+ * Copyright (C) 2019-2024 Aleksa Sarai <cyphar@cyphar.com>
+ * Copyright (C) 2019-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pathrs
+
+import (
+	"log"
+	"os"
+	"runtime"
+	"sync/atomic"
+)
+
+var leakWarning atomic.Bool
+
+// SetLeakWarning configures whether a warning should be logged (using the
+// standard [log] package) when a [Root] or [Handle] is garbage collected
+// without having been closed. This is disabled by default, and is intended to
+// help track down file descriptor leaks during development.
+//
+// Regardless of this setting, the file descriptor of a leaked [Root] or
+// [Handle] is closed when it is garbage collected.
+//
+// [log]: https://pkg.go.dev/log
+func SetLeakWarning(enabled bool) {
+	leakWarning.Store(enabled)
+}
+
+func newRoot(file *os.File) *Root {
+	root := &Root{inner: file}
+	runtime.SetFinalizer(root, func(r *Root) {
+		if leakWarning.Load() {
+			log.Printf("pathrs: root %q was garbage collected without being closed", r.inner.Name())
+		}
+		_ = r.Close()
+	})
+	return root
+}
+
+func newHandle(file *os.File) *Handle {
+	handle := &Handle{inner: file}
+	runtime.SetFinalizer(handle, func(h *Handle) {
+		if leakWarning.Load() {
+			log.Printf("pathrs: handle %q was garbage collected without being closed", h.inner.Name())
+		}
+		_ = h.Close()
+	})
+	return handle
+}
@@ -1,4 +1,4 @@
-//go:build linux
+//go:build linux && !nocgo
 
 /*
  * libpathrs: safe path resolution on Linux
@@ -38,19 +38,24 @@ char *cast_ptr(void *ptr) { return ptr; }
 */
 import "C"
 
-func fetchError(errID C.int) error {
+func fetchError(errID C.int, op, path string) error {
 	if errID >= 0 {
 		return nil
 	}
 	cErr := C.pathrs_errorinfo(errID)
 	defer C.pathrs_errorinfo_free(cErr)
 
-	var err error
-	if cErr != nil {
-		err = &Error{
-			errno:       syscall.Errno(cErr.saved_errno),
-			description: C.GoString(cErr.description),
-		}
+	if cErr == nil {
+		return nil
+	}
+	err := &Error{
+		Errno:       syscall.Errno(cErr.saved_errno),
+		Op:          op,
+		Path:        path,
+		Description: C.GoString(cErr.description),
+	}
+	if err.Errno == syscall.ELOOP {
+		return &SymlinkLoopError{Err: err}
 	}
 	return err
 }
@@ -60,12 +65,12 @@ func pathrsOpenRoot(path string) (uintptr, error) {
 	defer C.free(unsafe.Pointer(cPath))
 
 	fd := C.pathrs_open_root(cPath)
-	return uintptr(fd), fetchError(fd)
+	return uintptr(fd), fetchError(fd, "open_root", path)
 }
 
 func pathrsReopen(fd uintptr, flags int) (uintptr, error) {
 	newFd := C.pathrs_reopen(C.int(fd), C.int(flags))
-	return uintptr(newFd), fetchError(newFd)
+	return uintptr(newFd), fetchError(newFd, "reopen", "")
 }
 
 func pathrsInRootResolve(rootFd uintptr, path string) (uintptr, error) {
@@ -73,7 +78,7 @@ func pathrsInRootResolve(rootFd uintptr, path string) (uintptr, error) {
 	defer C.free(unsafe.Pointer(cPath))
 
 	fd := C.pathrs_inroot_resolve(C.int(rootFd), cPath)
-	return uintptr(fd), fetchError(fd)
+	return uintptr(fd), fetchError(fd, "resolve", path)
 }
 
 func pathrsInRootResolveNoFollow(rootFd uintptr, path string) (uintptr, error) {
@@ -81,7 +86,7 @@ func pathrsInRootResolveNoFollow(rootFd uintptr, path string) (uintptr, error) {
 	defer C.free(unsafe.Pointer(cPath))
 
 	fd := C.pathrs_inroot_resolve_nofollow(C.int(rootFd), cPath)
-	return uintptr(fd), fetchError(fd)
+	return uintptr(fd), fetchError(fd, "resolve_nofollow", path)
 }
 
 func pathrsInRootOpen(rootFd uintptr, path string, flags int) (uintptr, error) {
@@ -89,7 +94,7 @@ func pathrsInRootOpen(rootFd uintptr, path string, flags int) (uintptr, error) {
 	defer C.free(unsafe.Pointer(cPath))
 
 	fd := C.pathrs_inroot_open(C.int(rootFd), cPath, C.int(flags))
-	return uintptr(fd), fetchError(fd)
+	return uintptr(fd), fetchError(fd, "open", path)
 }
 
 func pathrsInRootReadlink(rootFd uintptr, path string) (string, error) {
@@ -102,7 +107,7 @@ func pathrsInRootReadlink(rootFd uintptr, path string) (string, error) {
 		n := C.pathrs_inroot_readlink(C.int(rootFd), cPath, C.cast_ptr(unsafe.Pointer(&linkBuf[0])), C.ulong(len(linkBuf)))
 		switch {
 		case int(n) < 0:
-			return "", fetchError(n)
+			return "", fetchError(n, "readlink", path)
 		case int(n) <= len(linkBuf):
 			return string(linkBuf[:int(n)]), nil
 		default:
@@ -121,7 +126,7 @@ func pathrsInRootRmdir(rootFd uintptr, path string) error {
 	defer C.free(unsafe.Pointer(cPath))
 
 	err := C.pathrs_inroot_rmdir(C.int(rootFd), cPath)
-	return fetchError(err)
+	return fetchError(err, "rmdir", path)
 }
 
 func pathrsInRootUnlink(rootFd uintptr, path string) error {
@@ -129,7 +134,7 @@ func pathrsInRootUnlink(rootFd uintptr, path string) error {
 	defer C.free(unsafe.Pointer(cPath))
 
 	err := C.pathrs_inroot_unlink(C.int(rootFd), cPath)
-	return fetchError(err)
+	return fetchError(err, "unlink", path)
 }
 
 func pathrsInRootRemoveAll(rootFd uintptr, path string) error {
@@ -137,7 +142,7 @@ func pathrsInRootRemoveAll(rootFd uintptr, path string) error {
 	defer C.free(unsafe.Pointer(cPath))
 
 	err := C.pathrs_inroot_remove_all(C.int(rootFd), cPath)
-	return fetchError(err)
+	return fetchError(err, "remove_all", path)
 }
 
 func pathrsInRootCreat(rootFd uintptr, path string, flags int, mode uint32) (uintptr, error) {
@@ -145,7 +150,7 @@ func pathrsInRootCreat(rootFd uintptr, path string, flags int, mode uint32) (uin
 	defer C.free(unsafe.Pointer(cPath))
 
 	fd := C.pathrs_inroot_creat(C.int(rootFd), cPath, C.int(flags), C.uint(mode))
-	return uintptr(fd), fetchError(fd)
+	return uintptr(fd), fetchError(fd, "creat", path)
 }
 
 func pathrsInRootRename(rootFd uintptr, src, dst string, flags uint) error {
@@ -156,7 +161,7 @@ func pathrsInRootRename(rootFd uintptr, src, dst string, flags uint) error {
 	defer C.free(unsafe.Pointer(cDst))
 
 	err := C.pathrs_inroot_rename(C.int(rootFd), cSrc, cDst, C.uint(flags))
-	return fetchError(err)
+	return fetchError(err, "rename", src)
 }
 
 func pathrsInRootMkdir(rootFd uintptr, path string, mode uint32) error {
@@ -164,7 +169,7 @@ func pathrsInRootMkdir(rootFd uintptr, path string, mode uint32) error {
 	defer C.free(unsafe.Pointer(cPath))
 
 	err := C.pathrs_inroot_mkdir(C.int(rootFd), cPath, C.uint(mode))
-	return fetchError(err)
+	return fetchError(err, "mkdir", path)
 }
 
 func pathrsInRootMkdirAll(rootFd uintptr, path string, mode uint32) (uintptr, error) {
@@ -172,7 +177,7 @@ func pathrsInRootMkdirAll(rootFd uintptr, path string, mode uint32) (uintptr, er
 	defer C.free(unsafe.Pointer(cPath))
 
 	fd := C.pathrs_inroot_mkdir_all(C.int(rootFd), cPath, C.uint(mode))
-	return uintptr(fd), fetchError(fd)
+	return uintptr(fd), fetchError(fd, "mkdir_all", path)
 }
 
 func pathrsInRootMknod(rootFd uintptr, path string, mode uint32, dev uint64) error {
@@ -180,7 +185,7 @@ func pathrsInRootMknod(rootFd uintptr, path string, mode uint32, dev uint64) err
 	defer C.free(unsafe.Pointer(cPath))
 
 	err := C.pathrs_inroot_mknod(C.int(rootFd), cPath, C.uint(mode), C.dev_t(dev))
-	return fetchError(err)
+	return fetchError(err, "mknod", path)
 }
 
 func pathrsInRootSymlink(rootFd uintptr, path, target string) error {
@@ -191,7 +196,7 @@ func pathrsInRootSymlink(rootFd uintptr, path, target string) error {
 	defer C.free(unsafe.Pointer(cTarget))
 
 	err := C.pathrs_inroot_symlink(C.int(rootFd), cPath, cTarget)
-	return fetchError(err)
+	return fetchError(err, "symlink", path)
 }
 
 func pathrsInRootHardlink(rootFd uintptr, path, target string) error {
@@ -202,7 +207,7 @@ func pathrsInRootHardlink(rootFd uintptr, path, target string) error {
 	defer C.free(unsafe.Pointer(cTarget))
 
 	err := C.pathrs_inroot_hardlink(C.int(rootFd), cPath, cTarget)
-	return fetchError(err)
+	return fetchError(err, "hardlink", path)
 }
 
 type pathrsProcBase C.pathrs_proc_base_t
@@ -220,7 +225,7 @@ func pathrsProcOpen(base pathrsProcBase, path string, flags int) (uintptr, error
 	defer C.free(unsafe.Pointer(cPath))
 
 	fd := C.pathrs_proc_open(cBase, cPath, C.int(flags))
-	return uintptr(fd), fetchError(fd)
+	return uintptr(fd), fetchError(fd, "proc_open", path)
 }
 
 func pathrsProcReadlink(base pathrsProcBase, path string) (string, error) {
@@ -237,7 +242,7 @@ func pathrsProcReadlink(base pathrsProcBase, path string) (string, error) {
 		n := C.pathrs_proc_readlink(cBase, cPath, C.cast_ptr(unsafe.Pointer(&linkBuf[0])), C.ulong(len(linkBuf)))
 		switch {
 		case int(n) < 0:
-			return "", fetchError(n)
+			return "", fetchError(n, "proc_readlink", path)
 		case int(n) <= len(linkBuf):
 			return string(linkBuf[:int(n)]), nil
 		default:
@@ -0,0 +1,540 @@
+//go:build linux && nocgo
+
+/*
+ * libpathrs: safe path resolution on Linux
+ * Copyright (C) 2019-2024 Aleksa Sarai <cyphar@cyphar.com>
+ * Copyright (C) 2019-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pathrs
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// This file contains a pure-Go implementation of the subset of libpathrs used
+// by this package, for builds with the "nocgo" build tag (where libpathrs
+// cannot be linked). Only the openat2(2) resolver is implemented, so Linux 5.6
+// or later is required.
+//
+// This implementation is deliberately kept feature-identical to the libpathrs
+// backend, and both are held to the same tests. Features that libpathrs does
+// not expose through its C API (such as resolver flags like
+// RESOLVE_NO_SYMLINKS and RESOLVE_NO_XDEV, or reporting the symlinks followed
+// during a resolution) are not provided here either, even where openat2(2)
+// could support them, so that programs behave the same regardless of which
+// backend they are built with.
+
+// openat2Retries is the number of times an openat2(2) call is retried if it
+// fails with EAGAIN (which RESOLVE_IN_ROOT returns if there was a concurrent
+// rename or mount that could have allowed an escape).
+const openat2Retries = 32
+
+const (
+	resolveInRoot = unix.RESOLVE_IN_ROOT | unix.RESOLVE_NO_MAGICLINKS
+	resolveProcfs = unix.RESOLVE_BENEATH | unix.RESOLVE_NO_MAGICLINKS | unix.RESOLVE_NO_XDEV
+)
+
+// nocgoError converts an error from a syscall into an [Error], matching the
+// errors returned by libpathrs.
+func nocgoError(err error, op, path, desc string) error {
+	if err == nil {
+		return nil
+	}
+	var errno syscall.Errno
+	_ = errors.As(err, &errno)
+	perr := &Error{
+		Errno:       errno,
+		Op:          op,
+		Path:        path,
+		Description: desc + ": " + err.Error(),
+	}
+	if perr.Errno == syscall.ELOOP {
+		return &SymlinkLoopError{Err: perr}
+	}
+	return perr
+}
+
+func openat2(dirFd int, path string, flags int, mode uint32, resolve uint64) (int, error) {
+	how := &unix.OpenHow{
+		Flags:   uint64(flags) | unix.O_CLOEXEC,
+		Mode:    uint64(mode),
+		Resolve: resolve,
+	}
+	var err error
+	for i := 0; i < openat2Retries; i++ {
+		var fd int
+		fd, err = unix.Openat2(dirFd, path, how)
+		if !errors.Is(err, unix.EAGAIN) {
+			return fd, err
+		}
+	}
+	return -1, err
+}
+
+// splitParent splits path into its parent directory and final component, in
+// the same manner as [Root.ResolveParent].
+func splitParent(path string) (string, string, error) {
+	dir, name := filepath.Split(strings.TrimRight(path, "/"))
+	if name == "" || name == "." || name == ".." {
+		return "", "", unix.EINVAL
+	}
+	if dir == "" {
+		dir = "."
+	}
+	return dir, name, nil
+}
+
+// inRootParent resolves the parent directory of path inside rootFd, and
+// returns an O_PATH handle to it along with the final component of path.
+func inRootParent(rootFd uintptr, path string) (int, string, error) {
+	dir, name, err := splitParent(path)
+	if err != nil {
+		return -1, "", fmt.Errorf("split path: %w", err)
+	}
+	dirFd, err := openat2(int(rootFd), dir, unix.O_PATH|unix.O_DIRECTORY, 0, resolveInRoot)
+	if err != nil {
+		return -1, "", fmt.Errorf("openat2 parent %q: %w", dir, err)
+	}
+	return dirFd, name, nil
+}
+
+// withInRootParent calls fn with a handle to the parent directory of path
+// inside rootFd (see inRootParent).
+func withInRootParent(rootFd uintptr, path, op string, fn func(dirFd int, name string) error) error {
+	dirFd, name, err := inRootParent(rootFd, path)
+	if err != nil {
+		return nocgoError(err, op, path, "resolve parent")
+	}
+	defer unix.Close(dirFd)
+
+	return nocgoError(fn(dirFd, name), op, path, op+" in parent")
+}
+
+// openProcfs opens a handle to the root of the host procfs, and verifies that
+// it really is the root of a procfs mount.
+func openProcfs() (int, error) {
+	procFd, err := unix.Open("/proc", unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("open /proc: %w", err)
+	}
+	var statfs unix.Statfs_t
+	if err := unix.Fstatfs(procFd, &statfs); err != nil {
+		_ = unix.Close(procFd)
+		return -1, fmt.Errorf("fstatfs /proc: %w", err)
+	}
+	var stat unix.Stat_t
+	if err := unix.Fstat(procFd, &stat); err != nil {
+		_ = unix.Close(procFd)
+		return -1, fmt.Errorf("fstat /proc: %w", err)
+	}
+	if statfs.Type != unix.PROC_SUPER_MAGIC || stat.Ino != 1 {
+		_ = unix.Close(procFd)
+		return -1, fmt.Errorf("/proc is not the root of a procfs mount: %w", unix.EXDEV)
+	}
+	return procFd, nil
+}
+
+func pathrsOpenRoot(path string) (uintptr, error) {
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	return uintptr(fd), nocgoError(err, "open_root", path, "open root")
+}
+
+func pathrsReopen(fd uintptr, flags int) (uintptr, error) {
+	var stat unix.Stat_t
+	if err := unix.Fstat(int(fd), &stat); err != nil {
+		return 0, nocgoError(err, "reopen", "", "fstat handle")
+	}
+	if stat.Mode&unix.S_IFMT == unix.S_IFLNK {
+		return 0, nocgoError(unix.ELOOP, "reopen", "", "symlink file handles cannot be reopened")
+	}
+	// O_NOFOLLOW is a no-op for non-symlinks, but would stop us from
+	// following the magic-link below.
+	flags &^= unix.O_NOFOLLOW
+
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	procFd, err := openProcfs()
+	if err != nil {
+		return 0, nocgoError(err, "reopen", "", "open procfs")
+	}
+	defer unix.Close(procFd)
+
+	fdDir, err := openat2(procFd, "thread-self/fd", unix.O_PATH|unix.O_DIRECTORY, 0, resolveProcfs)
+	if err != nil {
+		return 0, nocgoError(err, "reopen", "", "open /proc/thread-self/fd")
+	}
+	defer unix.Close(fdDir)
+
+	newFd, err := unix.Openat(fdDir, strconv.Itoa(int(fd)), flags|unix.O_CLOEXEC, 0)
+	return uintptr(newFd), nocgoError(err, "reopen", "", "reopen fd through procfs")
+}
+
+func pathrsInRootResolve(rootFd uintptr, path string) (uintptr, error) {
+	fd, err := openat2(int(rootFd), path, unix.O_PATH, 0, resolveInRoot)
+	return uintptr(fd), nocgoError(err, "resolve", path, "openat2")
+}
+
+func pathrsInRootResolveNoFollow(rootFd uintptr, path string) (uintptr, error) {
+	fd, err := openat2(int(rootFd), path, unix.O_PATH|unix.O_NOFOLLOW, 0, resolveInRoot)
+	return uintptr(fd), nocgoError(err, "resolve_nofollow", path, "openat2")
+}
+
+func pathrsInRootOpen(rootFd uintptr, path string, flags int) (uintptr, error) {
+	fd, err := openat2(int(rootFd), path, flags, 0, resolveInRoot)
+	return uintptr(fd), nocgoError(err, "open", path, "openat2")
+}
+
+func pathrsInRootReadlink(rootFd uintptr, path string) (string, error) {
+	fd, err := openat2(int(rootFd), path, unix.O_PATH|unix.O_NOFOLLOW, 0, resolveInRoot)
+	if err != nil {
+		return "", nocgoError(err, "readlink", path, "openat2")
+	}
+	defer unix.Close(fd)
+
+	// readlinkat(2) with an empty path returns ENOENT for non-symlinks, but
+	// readlink(2) returns EINVAL.
+	var stat unix.Stat_t
+	if err := unix.Fstat(fd, &stat); err != nil {
+		return "", nocgoError(err, "readlink", path, "fstat")
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFLNK {
+		return "", nocgoError(unix.EINVAL, "readlink", path, "path is not a symlink")
+	}
+
+	var buf []byte
+	target, err := readlinkatBuf(uintptr(fd), "", &buf)
+	return target, nocgoError(err, "readlink", path, "readlinkat")
+}
+
+func pathrsInRootRmdir(rootFd uintptr, path string) error {
+	return withInRootParent(rootFd, path, "rmdir", func(dirFd int, name string) error {
+		return unix.Unlinkat(dirFd, name, unix.AT_REMOVEDIR)
+	})
+}
+
+func pathrsInRootUnlink(rootFd uintptr, path string) error {
+	return withInRootParent(rootFd, path, "unlink", func(dirFd int, name string) error {
+		return unix.Unlinkat(dirFd, name, 0)
+	})
+}
+
+// removeAllAt recursively removes name inside dirFd, without following any
+// symlinks.
+func removeAllAt(dirFd int, name string) error {
+	err := unix.Unlinkat(dirFd, name, 0)
+	if !errors.Is(err, unix.EISDIR) {
+		return err
+	}
+
+	subFd, err := unix.Openat(dirFd, name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	subDir := mkFile(uintptr(subFd))
+	defer subDir.Close()
+
+	for {
+		names, err := subDir.Readdirnames(listDirBatchSize)
+		for _, child := range names {
+			if err := removeAllAt(subFd, child); err != nil && !errors.Is(err, unix.ENOENT) {
+				return err
+			}
+		}
+		if len(names) == 0 || err != nil {
+			break
+		}
+	}
+	return unix.Unlinkat(dirFd, name, unix.AT_REMOVEDIR)
+}
+
+func pathrsInRootRemoveAll(rootFd uintptr, path string) error {
+	err := withInRootParent(rootFd, path, "remove_all", func(dirFd int, name string) error {
+		return removeAllAt(dirFd, name)
+	})
+	if errors.Is(err, unix.ENOENT) {
+		return nil
+	}
+	return err
+}
+
+func pathrsInRootCreat(rootFd uintptr, path string, flags int, mode uint32) (uintptr, error) {
+	var fd int
+	err := withInRootParent(rootFd, path, "creat", func(dirFd int, name string) error {
+		var err error
+		// openat2(2) rejects any mode bits other than the permission bits.
+		fd, err = openat2(dirFd, name, flags|unix.O_CREAT|unix.O_NOFOLLOW, mode&^unix.S_IFMT,
+			unix.RESOLVE_BENEATH|unix.RESOLVE_NO_SYMLINKS)
+		return err
+	})
+	return uintptr(fd), err
+}
+
+func pathrsInRootRename(rootFd uintptr, src, dst string, flags uint) error {
+	return withInRootParent(rootFd, src, "rename", func(srcDirFd int, srcName string) error {
+		dstDirFd, dstName, err := inRootParent(rootFd, dst)
+		if err != nil {
+			return err
+		}
+		defer unix.Close(dstDirFd)
+
+		return unix.Renameat2(srcDirFd, srcName, dstDirFd, dstName, flags)
+	})
+}
+
+func pathrsInRootMkdir(rootFd uintptr, path string, mode uint32) error {
+	return withInRootParent(rootFd, path, "mkdir", func(dirFd int, name string) error {
+		return unix.Mkdirat(dirFd, name, mode)
+	})
+}
+
+// mkdirAllMaxSymlinks is the maximum number of symlinks followed by
+// pathrsInRootMkdirAll, matching the kernel's limit.
+const mkdirAllMaxSymlinks = 40
+
+func pathrsInRootMkdirAll(rootFd uintptr, path string, mode uint32) (uintptr, error) {
+	rootDirFd, err := openat2(int(rootFd), ".", unix.O_PATH|unix.O_DIRECTORY, 0, resolveInRoot)
+	if err != nil {
+		return 0, nocgoError(err, "mkdir_all", path, "open root")
+	}
+
+	// The existing part of the path is walked one component at a time from
+	// the current directory, and dirFds holds a handle to each directory
+	// walked through so far (with the root at the bottom). ".." pops a
+	// directory off the stack rather than being resolved by the kernel, so
+	// that it can never go above the root, and symlinks are expanded into the
+	// remaining components (with absolute symlinks starting again from the
+	// root).
+	dirFds := []int{rootDirFd}
+	defer func() {
+		for _, fd := range dirFds {
+			_ = unix.Close(fd)
+		}
+	}()
+
+	var (
+		remaining = strings.Split(path, "/")
+		create    []string
+		symlinks  int
+		buf       []byte
+		// symlinkRest is the number of remaining components that come after
+		// the outermost symlink being expanded, or -1 if no symlink is being
+		// expanded.
+		symlinkRest = -1
+	)
+	for len(remaining) > 0 {
+		if len(remaining) <= symlinkRest {
+			symlinkRest = -1
+		}
+		part := remaining[0]
+		remaining = remaining[1:]
+		if part == "" || part == "." {
+			continue
+		}
+		curFd := dirFds[len(dirFds)-1]
+
+		if part == ".." {
+			// ".." of the root is the root, as with RESOLVE_IN_ROOT.
+			if len(dirFds) > 1 {
+				_ = unix.Close(curFd)
+				dirFds = dirFds[:len(dirFds)-1]
+			}
+			continue
+		}
+
+		nextFd, err := unix.Openat(curFd, part, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if errors.Is(err, unix.ENOENT) {
+			// As with libpathrs, directories are never created through a
+			// dangling symlink.
+			if symlinkRest >= 0 {
+				return 0, nocgoError(unix.ENOTDIR, "mkdir_all", path, "dangling symlink component "+part)
+			}
+			create = append([]string{part}, remaining...)
+			break
+		} else if err != nil {
+			return 0, nocgoError(err, "mkdir_all", path, "open existing component "+part)
+		}
+
+		var stat unix.Stat_t
+		if err := unix.Fstat(nextFd, &stat); err != nil {
+			_ = unix.Close(nextFd)
+			return 0, nocgoError(err, "mkdir_all", path, "fstat existing component "+part)
+		}
+		switch stat.Mode & unix.S_IFMT {
+		case unix.S_IFDIR:
+			dirFds = append(dirFds, nextFd)
+		case unix.S_IFLNK:
+			target, err := readlinkatBuf(uintptr(nextFd), "", &buf)
+			_ = unix.Close(nextFd)
+			if err != nil {
+				return 0, nocgoError(err, "mkdir_all", path, "readlink existing component "+part)
+			}
+			symlinks++
+			if symlinks > mkdirAllMaxSymlinks {
+				return 0, nocgoError(unix.ELOOP, "mkdir_all", path, "follow symlink "+part)
+			}
+			if strings.HasPrefix(target, "/") {
+				for _, fd := range dirFds[1:] {
+					_ = unix.Close(fd)
+				}
+				dirFds = dirFds[:1]
+			}
+			if symlinkRest < 0 {
+				symlinkRest = len(remaining)
+			}
+			remaining = append(strings.Split(target, "/"), remaining...)
+		default:
+			_ = unix.Close(nextFd)
+			return 0, nocgoError(unix.ENOTDIR, "mkdir_all", path, "open existing component "+part)
+		}
+	}
+
+	// As with libpathrs, ".." is not allowed in the part of the path that
+	// does not exist yet.
+	for _, part := range create {
+		if part == ".." {
+			return 0, &Error{
+				Errno:       unix.ENOENT,
+				Op:          "mkdir_all",
+				Path:        path,
+				Description: "yet-to-be-created path contains '..' components",
+			}
+		}
+	}
+	for _, part := range create {
+		if part == "" || part == "." {
+			continue
+		}
+		curFd := dirFds[len(dirFds)-1]
+		if err := unix.Mkdirat(curFd, part, mode); err != nil && !errors.Is(err, unix.EEXIST) {
+			return 0, nocgoError(err, "mkdir_all", path, "mkdirat "+part)
+		}
+		// O_NOFOLLOW makes sure that a symlink swapped in after the mkdirat
+		// is never followed.
+		nextFd, err := unix.Openat(curFd, part, unix.O_PATH|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return 0, nocgoError(err, "mkdir_all", path, "open new component "+part)
+		}
+		dirFds = append(dirFds, nextFd)
+	}
+
+	fd := dirFds[len(dirFds)-1]
+	dirFds = dirFds[:len(dirFds)-1]
+	return uintptr(fd), nil
+}
+
+func pathrsInRootMknod(rootFd uintptr, path string, mode uint32, dev uint64) error {
+	return withInRootParent(rootFd, path, "mknod", func(dirFd int, name string) error {
+		return unix.Mknodat(dirFd, name, mode, int(dev))
+	})
+}
+
+func pathrsInRootSymlink(rootFd uintptr, path, target string) error {
+	return withInRootParent(rootFd, path, "symlink", func(dirFd int, name string) error {
+		return unix.Symlinkat(target, dirFd, name)
+	})
+}
+
+func pathrsInRootHardlink(rootFd uintptr, path, target string) error {
+	return withInRootParent(rootFd, path, "hardlink", func(dirFd int, name string) error {
+		targetDirFd, targetName, err := inRootParent(rootFd, target)
+		if err != nil {
+			return err
+		}
+		defer unix.Close(targetDirFd)
+
+		return unix.Linkat(targetDirFd, targetName, dirFd, name, 0)
+	})
+}
+
+type pathrsProcBase int
+
+const (
+	pathrsProcRoot pathrsProcBase = iota
+	pathrsProcSelf
+	pathrsProcThreadSelf
+)
+
+func (b pathrsProcBase) prefix() string {
+	switch b {
+	case pathrsProcSelf:
+		return "self/"
+	case pathrsProcThreadSelf:
+		return "thread-self/"
+	default:
+		return ""
+	}
+}
+
+// withProcfsParent calls fn with a handle to the parent directory of path
+// inside the given procfs base. The parent is resolved without following any
+// magic-links or crossing any mounts, while the final component is left to
+// fn (so that trailing magic-links can be followed if requested).
+func withProcfsParent(base pathrsProcBase, path, op string, fn func(dirFd int, name string) error) error {
+	procFd, err := openProcfs()
+	if err != nil {
+		return nocgoError(err, op, path, "open procfs")
+	}
+	defer unix.Close(procFd)
+
+	dir, name, err := splitParent(base.prefix() + path)
+	if err != nil {
+		return nocgoError(err, op, path, "split path")
+	}
+	dirFd, err := openat2(procFd, dir, unix.O_PATH|unix.O_DIRECTORY, 0, resolveProcfs)
+	if err != nil {
+		return nocgoError(err, op, path, "openat2 parent")
+	}
+	defer unix.Close(dirFd)
+
+	return nocgoError(fn(dirFd, name), op, path, op+" in parent")
+}
+
+func pathrsProcOpen(base pathrsProcBase, path string, flags int) (uintptr, error) {
+	var fd int
+	err := withProcfsParent(base, path, "proc_open", func(dirFd int, name string) error {
+		var err error
+		if flags&unix.O_NOFOLLOW != 0 {
+			fd, err = openat2(dirFd, name, flags, 0, resolveProcfs)
+		} else {
+			// Trailing magic-links (such as /proc/self/exe) are followed.
+			fd, err = unix.Openat(dirFd, name, flags|unix.O_CLOEXEC, 0)
+		}
+		return err
+	})
+	return uintptr(fd), err
+}
+
+func pathrsProcReadlink(base pathrsProcBase, path string) (string, error) {
+	var target string
+	err := withProcfsParent(base, path, "proc_readlink", func(dirFd int, name string) error {
+		var (
+			buf []byte
+			err error
+		)
+		target, err = readlinkatBuf(uintptr(dirFd), name, &buf)
+		return err
+	})
+	return target, err
+}
@@ -0,0 +1,112 @@
+//go:build linux
+
+/*
+ * libpathrs: safe path resolution on Linux
+ * Copyright (C) 2019-2024 Aleksa Sarai <cyphar@cyphar.com>
+ * Copyright (C) 2019-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pathrs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// FileLock is an advisory flock(2) lock on a file within a [Root], returned
+// by [Root.Lock] and [Root.TryLock]. The lock is tied to the file descriptor
+// opened when taking the lock, and is held until [FileLock.Unlock] is called
+// (or the process exits).
+type FileLock struct {
+	file     *os.File
+	unlocked atomic.Bool
+}
+
+func (r *Root) lock(path string, exclusive, nonBlocking bool) (*FileLock, error) {
+	how := unix.LOCK_SH
+	if exclusive {
+		how = unix.LOCK_EX
+	}
+	if nonBlocking {
+		how |= unix.LOCK_NB
+	}
+
+	file, err := r.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	_, err = withFileFd(file, func(fd uintptr) (struct{}, error) {
+		for {
+			err := unix.Flock(int(fd), how)
+			switch {
+			case errors.Is(err, unix.EINTR):
+				continue
+			case errors.Is(err, unix.EWOULDBLOCK):
+				return struct{}{}, fmt.Errorf("flock %s: %w: %w", path, ErrWouldBlock, err)
+			case err != nil:
+				return struct{}{}, fmt.Errorf("flock %s: %w", path, err)
+			}
+			return struct{}{}, nil
+		}
+	})
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return &FileLock{file: file}, nil
+}
+
+// Lock takes an advisory flock(2) lock on the file at the given path within
+// the [Root]'s directory tree, blocking until the lock can be acquired. If
+// exclusive is true, an exclusive (LOCK_EX) lock is taken, otherwise a shared
+// (LOCK_SH) lock is taken. All symlinks (including trailing symlinks) are
+// followed within the rootfs, and the file is opened for reading (which is
+// sufficient for flock(2) of any file type, including directories).
+func (r *Root) Lock(path string, exclusive bool) (*FileLock, error) {
+	return r.lock(path, exclusive, false)
+}
+
+// TryLock is like [Root.Lock], except that if the lock is already held by
+// someone else, an error wrapping [ErrWouldBlock] is returned immediately
+// rather than waiting for the lock to be released.
+func (r *Root) TryLock(path string, exclusive bool) (*FileLock, error) {
+	return r.lock(path, exclusive, true)
+}
+
+// Name returns the name of the locked file.
+func (l *FileLock) Name() string {
+	return l.file.Name()
+}
+
+// Unlock releases the lock and closes the underlying file. Calling Unlock
+// more than once returns [ErrClosed].
+func (l *FileLock) Unlock() error {
+	if !l.unlocked.CompareAndSwap(false, true) {
+		return ErrClosed
+	}
+	_, err := withFileFd(l.file, func(fd uintptr) (struct{}, error) {
+		if err := unix.Flock(int(fd), unix.LOCK_UN); err != nil {
+			return struct{}{}, fmt.Errorf("unlock %s: %w", l.file.Name(), err)
+		}
+		return struct{}{}, nil
+	})
+	// Closing the file also releases the lock, so we close it even if
+	// LOCK_UN failed.
+	return errors.Join(err, l.file.Close())
+}
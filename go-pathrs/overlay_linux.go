@@ -0,0 +1,86 @@
+//go:build linux
+
+/*
+ * libpathrs: safe path resolution on Linux
+ * Copyright (C) 2019-2024 Aleksa Sarai <cyphar@cyphar.com>
+ * Copyright (C) 2019-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pathrs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// overlayOpaqueXattr is the extended attribute used by overlayfs to mark a
+// directory in an upper layer as opaque.
+const overlayOpaqueXattr = "trusted.overlay.opaque"
+
+// CreateWhiteout creates an overlayfs whiteout at the given path within the
+// [Root]'s directory tree. A whiteout is a character device with device
+// number 0/0, and hides the corresponding path in the lower layers of an
+// overlayfs mount. As with [Root.Mknod], an existing path is not replaced.
+//
+// Creating device nodes requires CAP_MKNOD (though on Linux 5.8 and later,
+// whiteouts can also be created inside user namespaces). If the caller lacks
+// the necessary privileges, an error wrapping EPERM is returned.
+func (r *Root) CreateWhiteout(path string) error {
+	err := r.Mknod(path, os.ModeDevice|os.ModeCharDevice, Mkdev(0, 0))
+	if errors.Is(err, unix.EPERM) {
+		return fmt.Errorf("create whiteout (requires CAP_MKNOD): %w", err)
+	}
+	return err
+}
+
+// SetOpaque marks the directory at the given path within the [Root]'s
+// directory tree as an overlayfs opaque directory (by setting the
+// "trusted.overlay.opaque" extended attribute to "y"), which hides the
+// contents of the corresponding directories in the lower layers of an
+// overlayfs mount. All symlinks (including trailing symlinks) are followed
+// within the rootfs. If the path is not a directory, an error wrapping
+// ENOTDIR is returned.
+//
+// Setting "trusted.*" extended attributes requires CAP_SYS_ADMIN. If the
+// caller lacks the necessary privileges, an error wrapping EPERM is returned.
+func (r *Root) SetOpaque(path string) error {
+	err := r.withXattrPath(path, func(xattrPath string) error {
+		// xattrPath is relative to the verified procfs handle (see
+		// withXattrPath), so the stat goes through it as well.
+		var stat unix.Stat_t
+		if err := unix.Stat(xattrPath, &stat); err != nil {
+			return fmt.Errorf("stat: %w", err)
+		}
+		if stat.Mode&unix.S_IFMT != unix.S_IFDIR {
+			return &Error{
+				Errno:       unix.ENOTDIR,
+				Op:          "set_opaque",
+				Path:        path,
+				Description: "opaque path is not a directory",
+			}
+		}
+		if err := unix.Setxattr(xattrPath, overlayOpaqueXattr, []byte("y"), 0); err != nil {
+			return fmt.Errorf("setxattr(%q): %w", overlayOpaqueXattr, err)
+		}
+		return nil
+	})
+	if errors.Is(err, unix.EPERM) {
+		return fmt.Errorf("set opaque (requires CAP_SYS_ADMIN): %w", err)
+	}
+	return err
+}
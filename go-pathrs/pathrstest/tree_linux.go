@@ -0,0 +1,241 @@
+//go:build linux
+
+/*
+ * libpathrs: safe path resolution on Linux
+ * Copyright (C) 2019-2024 Aleksa Sarai <cyphar@cyphar.com>
+ * Copyright (C) 2019-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package pathrstest provides helpers for constructing on-disk directory
+// trees (including adversarial ones, with symlinks that attempt to escape the
+// tree) for use in tests of code that uses package pathrs.
+package pathrstest
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// EntryKind is the type of inode described by an [Entry].
+type EntryKind int
+
+const (
+	// File is a regular file, with contents [Entry.Data].
+	File EntryKind = iota
+	// Dir is a directory.
+	Dir
+	// Symlink is a symbolic link pointing to [Entry.Target]. The target is
+	// not interpreted in any way, so it may be absolute or contain ".."
+	// components that escape the tree.
+	Symlink
+)
+
+const (
+	defaultFileMode os.FileMode = 0o644
+	defaultDirMode  os.FileMode = 0o755
+)
+
+// Entry describes a single inode to be created by [BuildTree].
+type Entry struct {
+	// Kind is the type of inode to create.
+	Kind EntryKind
+	// Mode is the permission bits (and optionally os.ModeSetuid,
+	// os.ModeSetgid, and os.ModeSticky) of the inode. If zero, 0o644 is used
+	// for files and 0o755 is used for directories. Mode is ignored for
+	// symlinks.
+	Mode os.FileMode
+	// Data is the contents of a [File].
+	Data []byte
+	// Target is the target of a [Symlink].
+	Target string
+}
+
+// BuildTree creates the entries described by spec inside the existing
+// directory base. The keys of spec are slash-separated paths relative to base,
+// and any missing parent directories are created with mode 0o755. The
+// entries are created in lexical order, and the modes of directories are only
+// applied once all entries have been created (so that directories which are
+// not writable can still be populated).
+//
+// Keys must not be absolute or contain ".." components, but symlink targets
+// may point anywhere. Entries are created relative to file descriptors for
+// their parent directories, and symlinks are never followed while building
+// the tree (including symlinks created by earlier entries), so adversarial
+// symlinks cannot cause BuildTree to write outside of base. A key which has a
+// symlink as one of its parent components results in an error, as does a
+// key for a file or symlink that already exists.
+func BuildTree(base string, spec map[string]Entry) error {
+	names := make([]string, 0, len(spec))
+	for name := range spec {
+		if err := checkName(name); err != nil {
+			return err
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	baseFd, err := unix.Open(base, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("open base directory %q: %w", base, err)
+	}
+	defer unix.Close(baseFd)
+
+	var dirs []string
+	for _, name := range names {
+		entry := spec[name]
+		if err := createEntry(baseFd, name, entry); err != nil {
+			return err
+		}
+		if entry.Kind == Dir {
+			dirs = append(dirs, name)
+		}
+	}
+
+	// Apply directory modes deepest-first, so that removing write or search
+	// permission from a directory doesn't stop us from modifying its
+	// children.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		name := dirs[i]
+		err := withEntryParent(baseFd, name, func(parentFd int, leaf string) error {
+			fd, err := unix.Openat(parentFd, leaf, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+			if err != nil {
+				return err
+			}
+			defer unix.Close(fd)
+			return unix.Fchmod(fd, unixMode(modeOr(spec[name].Mode, defaultDirMode)))
+		})
+		if err != nil {
+			return fmt.Errorf("chmod directory %q: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// createEntry creates the inode described by entry at name (relative to
+// baseFd), creating any missing parent directories.
+func createEntry(baseFd int, name string, entry Entry) error {
+	return withEntryParent(baseFd, name, func(parentFd int, leaf string) error {
+		switch entry.Kind {
+		case File:
+			fd, err := unix.Openat(parentFd, leaf, unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0o600)
+			if err != nil {
+				return fmt.Errorf("create file %q: %w", name, err)
+			}
+			file := os.NewFile(uintptr(fd), name)
+			defer file.Close()
+			if _, err := file.Write(entry.Data); err != nil {
+				return fmt.Errorf("write file %q: %w", name, err)
+			}
+			if err := unix.Fchmod(fd, unixMode(modeOr(entry.Mode, defaultFileMode))); err != nil {
+				return fmt.Errorf("chmod file %q: %w", name, err)
+			}
+		case Dir:
+			if err := mkdirNoFollow(parentFd, leaf, 0o700); err != nil {
+				return fmt.Errorf("create directory %q: %w", name, err)
+			}
+		case Symlink:
+			if err := unix.Symlinkat(entry.Target, parentFd, leaf); err != nil {
+				return fmt.Errorf("create symlink %q: %w", name, err)
+			}
+		default:
+			return fmt.Errorf("entry %q: unknown entry kind %d", name, entry.Kind)
+		}
+		return nil
+	})
+}
+
+// withEntryParent walks (and creates, if necessary) the parent directories of
+// name relative to baseFd without following any symlinks, and calls fn with
+// a file descriptor for the parent directory and the final component of name.
+func withEntryParent(baseFd int, name string, fn func(parentFd int, leaf string) error) error {
+	parts := strings.Split(strings.Trim(name, "/"), "/")
+	curFd, err := unix.Dup(baseFd)
+	if err != nil {
+		return fmt.Errorf("dup base directory: %w", err)
+	}
+	defer func() { _ = unix.Close(curFd) }()
+
+	for _, part := range parts[:len(parts)-1] {
+		if part == "" || part == "." {
+			continue
+		}
+		if err := mkdirNoFollow(curFd, part, defaultDirMode); err != nil {
+			return fmt.Errorf("create parent of %q: %w", name, err)
+		}
+		nextFd, err := unix.Openat(curFd, part, unix.O_PATH|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return fmt.Errorf("open parent of %q: %w", name, err)
+		}
+		_ = unix.Close(curFd)
+		curFd = nextFd
+	}
+	return fn(curFd, parts[len(parts)-1])
+}
+
+// mkdirNoFollow creates the directory name inside dirFd, treating an existing
+// directory (but not a symlink to one) as success.
+func mkdirNoFollow(dirFd int, name string, mode os.FileMode) error {
+	err := unix.Mkdirat(dirFd, name, unixMode(mode))
+	if !errors.Is(err, unix.EEXIST) {
+		return err
+	}
+	var stat unix.Stat_t
+	if err := unix.Fstatat(dirFd, name, &stat, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return err
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFDIR {
+		return fmt.Errorf("%q exists and is not a directory: %w", name, unix.ENOTDIR)
+	}
+	return nil
+}
+
+func checkName(name string) error {
+	if name == "" || strings.HasPrefix(name, "/") {
+		return fmt.Errorf("invalid entry name %q: must be a non-empty relative path", name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return fmt.Errorf("invalid entry name %q: must not contain '..' components", name)
+		}
+	}
+	return nil
+}
+
+func modeOr(mode, def os.FileMode) os.FileMode {
+	if mode == 0 {
+		return def
+	}
+	return mode
+}
+
+// unixMode converts the permission and special bits of mode to a unix mode.
+func unixMode(mode os.FileMode) uint32 {
+	sysMode := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		sysMode |= unix.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		sysMode |= unix.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		sysMode |= unix.S_ISVTX
+	}
+	return sysMode
+}
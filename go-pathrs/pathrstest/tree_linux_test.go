@@ -0,0 +1,111 @@
+//go:build linux
+
+/*
+ * libpathrs: safe path resolution on Linux
+ * Copyright (C) 2019-2024 Aleksa Sarai <cyphar@cyphar.com>
+ * Copyright (C) 2019-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pathrstest
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildTree(t *testing.T) {
+	base := t.TempDir()
+	err := BuildTree(base, map[string]Entry{
+		"a/b/file":    {Kind: File, Data: []byte("data"), Mode: 0o600},
+		"a/b":         {Kind: Dir, Mode: 0o500},
+		"c":           {Kind: Dir},
+		"c/link":      {Kind: Symlink, Target: "../../../etc"},
+		"implicit/ok": {Kind: File},
+	})
+	if err != nil {
+		t.Fatalf("BuildTree: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(base, "a/b/file"))
+	if err != nil || string(data) != "data" {
+		t.Errorf("a/b/file contents = %q, %v; want %q", data, err, "data")
+	}
+	for path, want := range map[string]os.FileMode{
+		"a/b/file":    0o600,
+		"a/b":         os.ModeDir | 0o500,
+		"a":           os.ModeDir | defaultDirMode,
+		"c":           os.ModeDir | defaultDirMode,
+		"c/link":      os.ModeSymlink | 0o777,
+		"implicit":    os.ModeDir | defaultDirMode,
+		"implicit/ok": defaultFileMode,
+	} {
+		info, err := os.Lstat(filepath.Join(base, path))
+		if err != nil {
+			t.Errorf("lstat %s: %v", path, err)
+			continue
+		}
+		if got := info.Mode(); got != want {
+			t.Errorf("mode of %s = %v; want %v", path, got, want)
+		}
+	}
+	target, err := os.Readlink(filepath.Join(base, "c/link"))
+	if err != nil || target != "../../../etc" {
+		t.Errorf("c/link target = %q, %v; want %q", target, err, "../../../etc")
+	}
+}
+
+func TestBuildTreeNoFollow(t *testing.T) {
+	for name, spec := range map[string]map[string]Entry{
+		"file-through-symlink": {
+			"a":   {Kind: Symlink},
+			"a/x": {Kind: File},
+		},
+		"dir-through-symlink": {
+			"a":     {Kind: Symlink},
+			"a/x/y": {Kind: Dir},
+		},
+		"dir-over-symlink": {
+			"a":   {Kind: Symlink},
+			"a/.": {Kind: Dir},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			outside := t.TempDir()
+			base := t.TempDir()
+			// Point the symlink outside the tree.
+			spec["a"] = Entry{Kind: Symlink, Target: outside}
+
+			if err := BuildTree(base, spec); err == nil {
+				t.Errorf("BuildTree through symlink succeeded")
+			}
+			entries, err := os.ReadDir(outside)
+			if err != nil {
+				t.Fatalf("read outside directory: %v", err)
+			}
+			if len(entries) != 0 {
+				t.Errorf("BuildTree created %d entries outside of the tree", len(entries))
+			}
+		})
+	}
+}
+
+func TestBuildTreeBadName(t *testing.T) {
+	for _, name := range []string{"", "/abs", "a/../b", ".."} {
+		if err := BuildTree(t.TempDir(), map[string]Entry{name: {Kind: File}}); err == nil {
+			t.Errorf("BuildTree with name %q succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+//go:build linux
+
+/*
+ * libpathrs: safe path resolution on Linux
+ * Copyright (C) 2019-2024 Aleksa Sarai <cyphar@cyphar.com>
+ * Copyright (C) 2019-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pathrs
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+type rootKey struct {
+	dev, ino uint64
+}
+
+type pooledRoot struct {
+	root *Root
+	key  rootKey
+	refs int
+}
+
+// RootPool is a cache of [Root]s, to avoid repeatedly opening the same
+// directory with [OpenRoot]. [Root]s are keyed by the device and inode
+// numbers of the directory, and are reference counted -- each [Root] returned
+// by [RootPool.Get] must be released with [RootPool.Release] (not
+// [Root.Close]), and the [Root] is only closed once every reference to it has
+// been released.
+//
+// If the directory at a path is replaced (for instance, if it is removed and
+// re-created), the next call to [RootPool.Get] for that path opens a new
+// [Root] for the new directory. Existing references to the old [Root] remain
+// valid until they are released.
+//
+// The zero value is an empty pool ready to use. A RootPool is safe for
+// concurrent use, and must not be copied after first use.
+type RootPool struct {
+	mu    sync.Mutex
+	roots map[rootKey]*pooledRoot
+	refs  map[*Root]*pooledRoot
+}
+
+// poolOpenRoot is used by [RootPool.Get] to open new [Root]s. It is only
+// changed by tests, to widen the window for racing Gets.
+var poolOpenRoot = OpenRoot
+
+func statKey(stat *unix.Stat_t) rootKey {
+	return rootKey{dev: stat.Dev, ino: stat.Ino}
+}
+
+// Get returns a [Root] for the directory at the given path, re-using a
+// cached [Root] if the directory is already open in the pool. The returned
+// [Root] must be released with [RootPool.Release] once it is no longer
+// needed.
+//
+// Cached [Root]s are checked with [Root.Valid] before being re-used, and a
+// [Root] whose directory has been deleted is evicted from the pool (existing
+// references to it remain valid until they are released).
+func (p *RootPool) Get(path string) (*Root, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(path, &stat); err == nil {
+		p.mu.Lock()
+		root := p.getCachedLocked(statKey(&stat))
+		p.mu.Unlock()
+		if root != nil {
+			return root, nil
+		}
+	}
+
+	// Open the root without holding p.mu, so that a slow path does not block
+	// every other Get and Release.
+	root, err := poolOpenRoot(path)
+	if err != nil {
+		return nil, err
+	}
+	// The directory could have been swapped between the stat above and
+	// OpenRoot, so use the key of the directory we actually opened.
+	key, err := withFileFd(root.inner, func(fd uintptr) (rootKey, error) {
+		if err := unix.Fstat(int(fd), &stat); err != nil {
+			return rootKey{}, fmt.Errorf("fstat new root: %w", err)
+		}
+		return statKey(&stat), nil
+	})
+	if err != nil {
+		_ = root.Close()
+		return nil, err
+	}
+
+	// Another Get may have opened the same directory while we were in
+	// OpenRoot, in which case we use its [Root] instead of ours. The check
+	// and the insert must be done with a single hold of p.mu, otherwise two
+	// Gets could both miss and insert different [Root]s.
+	p.mu.Lock()
+	cached := p.getCachedLocked(key)
+	if cached == nil {
+		entry := &pooledRoot{root: root, key: key, refs: 1}
+		p.roots[key] = entry
+		p.refs[root] = entry
+	}
+	p.mu.Unlock()
+
+	if cached != nil {
+		_ = root.Close()
+		return cached, nil
+	}
+	return root, nil
+}
+
+// getCachedLocked returns a new reference to the cached [Root] for the given
+// key, or nil if there is no valid [Root] for it in the pool. Cached [Root]s
+// whose directory has been deleted are evicted. p.mu must be held.
+func (p *RootPool) getCachedLocked(key rootKey) *Root {
+	if p.roots == nil {
+		p.roots = make(map[rootKey]*pooledRoot)
+		p.refs = make(map[*Root]*pooledRoot)
+	}
+
+	entry, ok := p.roots[key]
+	if !ok {
+		return nil
+	}
+	if valid, err := entry.root.Valid(); err != nil || !valid {
+		// Outstanding references stay in p.refs so they can still be
+		// released, but the entry is no longer handed out.
+		delete(p.roots, key)
+		return nil
+	}
+	entry.refs++
+	return entry.root
+}
+
+// Release releases a reference to a [Root] returned by [RootPool.Get]. Once
+// every reference to the [Root] has been released, the [Root] is closed and
+// removed from the pool. Releasing a [Root] that did not come from the pool
+// (or releasing it more times than it was returned by [RootPool.Get]) results
+// in an error.
+func (p *RootPool) Release(root *Root) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entry, ok := p.refs[root]
+	if !ok {
+		return errors.New("root was not returned by this pool or has already been released")
+	}
+	entry.refs--
+	if entry.refs > 0 {
+		return nil
+	}
+	delete(p.refs, root)
+	// The entry may have been evicted (and its key re-used by a new entry)
+	// while it still had outstanding references.
+	if p.roots[entry.key] == entry {
+		delete(p.roots, entry.key)
+	}
+	return root.Close()
+}
@@ -0,0 +1,153 @@
+//go:build linux
+
+/*
+ * libpathrs: safe path resolution on Linux
+ * Copyright (C) 2019-2024 Aleksa Sarai <cyphar@cyphar.com>
+ * Copyright (C) 2019-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pathrs
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestRootPoolGet(t *testing.T) {
+	var pool RootPool
+	dir := t.TempDir()
+
+	root1, err := pool.Get(dir)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	root2, err := pool.Get(dir)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if root1 != root2 {
+		t.Errorf("second Get returned a different root")
+	}
+	for _, root := range []*Root{root1, root2} {
+		if err := pool.Release(root); err != nil {
+			t.Errorf("release: %v", err)
+		}
+	}
+	if err := pool.Release(root1); err == nil {
+		t.Errorf("releasing too many times should fail")
+	}
+}
+
+func TestRootPoolGetConcurrent(t *testing.T) {
+	var pool RootPool
+	dir := t.TempDir()
+
+	// Every Get waits in OpenRoot until all of them have missed the cache, so
+	// that they all go through the re-check and race to insert their own
+	// [Root].
+	const gets = 64
+	defer func(openRoot func(string) (*Root, error)) { poolOpenRoot = openRoot }(poolOpenRoot)
+	var opening sync.WaitGroup
+	poolOpenRoot = func(path string) (*Root, error) {
+		opening.Done()
+		opening.Wait()
+		return OpenRoot(path)
+	}
+
+	for round := 0; round < 20; round++ {
+		roots := make([]*Root, gets)
+		start := make(chan struct{})
+		opening.Add(gets)
+		var wg sync.WaitGroup
+		for i := range roots {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				<-start
+				root, err := pool.Get(dir)
+				if err != nil {
+					t.Errorf("get: %v", err)
+				}
+				roots[i] = root
+			}(i)
+		}
+		close(start)
+		wg.Wait()
+		if t.Failed() {
+			t.FailNow()
+		}
+
+		for i, root := range roots {
+			if root != roots[0] {
+				t.Errorf("round %d: Get %d returned a different root", round, i)
+			}
+		}
+		for _, root := range roots {
+			if err := pool.Release(root); err != nil {
+				t.Errorf("round %d: release: %v", round, err)
+			}
+		}
+	}
+}
+
+func TestRootPoolDeleted(t *testing.T) {
+	var pool RootPool
+	dir := filepath.Join(t.TempDir(), "root")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	old, err := pool.Get(dir)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if err := os.Remove(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := pool.Get(dir)
+	if err != nil {
+		t.Fatalf("get after re-create: %v", err)
+	}
+	if root == old {
+		t.Errorf("Get returned a root for the deleted directory")
+	}
+	if valid, err := root.Valid(); err != nil || !valid {
+		t.Errorf("new root Valid() = %v, %v; want true", valid, err)
+	}
+
+	// The old reference can still be released, without affecting the new
+	// entry.
+	if err := pool.Release(old); err != nil {
+		t.Errorf("release deleted root: %v", err)
+	}
+	again, err := pool.Get(dir)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if again != root {
+		t.Errorf("releasing the deleted root evicted the new entry")
+	}
+	for _, r := range []*Root{root, again} {
+		if err := pool.Release(r); err != nil {
+			t.Errorf("release: %v", err)
+		}
+	}
+}
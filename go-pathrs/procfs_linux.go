@@ -26,6 +26,8 @@ import (
 	"runtime"
 )
 
+// ProcBase is used with [ProcOpen] and [ProcReadlink] to indicate what procfs
+// directory the given path is relative to.
 type ProcBase int
 
 const (
@@ -68,12 +70,12 @@ func (b ProcBase) namePrefix() string {
 }
 
 // ProcHandleCloser is a callback that needs to be called when you are done
-// operating on an [os.File] fetched using [ProcThreadSelfOpen].
+// operating on an [os.File] fetched using [ProcThreadSelfOpen] (or [ProcOpen]
+// with [ProcBaseThreadSelf]).
 //
 // [os.File]: https://pkg.go.dev/os#File
 type ProcHandleCloser func()
 
-// TODO: Should we expose procOpen?
 func procOpen(base ProcBase, path string, flags int) (*os.File, ProcHandleCloser, error) {
 	pathrsBase, err := base.toPathrsBase()
 	if err != nil {
@@ -100,6 +102,29 @@ func procOpen(base ProcBase, path string, flags int) (*os.File, ProcHandleCloser
 	panic("unreachable")
 }
 
+// ProcOpen safely opens a given path from inside the given procfs base. Like
+// all of the procfs helpers in this package, this uses libpathrs's hardened
+// procfs handle and so it is safe against attackers that have over-mounted
+// parts of /proc (such as a bind-mount on top of /proc/self/fd).
+//
+// This is a generic version of [ProcRootOpen], [ProcSelfOpen], and
+// [ProcThreadSelfOpen]. The returned ProcHandleCloser must be called once you
+// are done using the returned [os.File] (see [ProcThreadSelfOpen] for more
+// details). For bases other than [ProcBaseThreadSelf], it is a no-op, but
+// callers should call it regardless of the base used.
+//
+// [os.File]: https://pkg.go.dev/os#File
+func ProcOpen(base ProcBase, path string, flags int) (*os.File, ProcHandleCloser, error) {
+	file, closer, err := procOpen(base, path, flags)
+	if err != nil {
+		return nil, nil, err
+	}
+	if closer == nil {
+		closer = func() {}
+	}
+	return file, closer, nil
+}
+
 // ProcRootOpen safely opens a given path from inside /proc/.
 //
 // This function must only be used for accessing global information from procfs
@@ -0,0 +1,220 @@
+//go:build linux
+
+/*
+ * libpathrs: safe path resolution on Linux
+ * Copyright (C) 2019-2024 Aleksa Sarai <cyphar@cyphar.com>
+ * Copyright (C) 2019-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pathrs
+
+import (
+	"container/list"
+	"errors"
+	"os"
+	"sync"
+)
+
+type reopenKey struct {
+	handle *Handle
+	flags  int
+}
+
+type reopenEntry struct {
+	key  reopenKey
+	file *os.File
+	refs int
+	// elem is the entry's element in the LRU list, or nil if the entry is
+	// not (or is no longer) cached.
+	elem *list.Element
+}
+
+// ReopenCache is a cache of files re-opened from [Handle]s with
+// [Handle.Reopen], to avoid repeatedly opening new file descriptors when the
+// same [Handle] is re-opened with the same flags many times. The cache is
+// bounded by a maximum number of open files, and the least-recently-used
+// unused file is closed when more room is needed.
+//
+// Files are reference counted -- each file returned by [ReopenCache.Reopen]
+// must be released with [ReopenCache.Release] (not [os.File.Close]). Note
+// that a cached file is shared between all users of the cache, including its
+// file offset, so callers should prefer position-independent operations (such
+// as [os.File.ReadAt]) on cached files.
+//
+// When a [Handle] is closed, all of its cached files are closed (files which
+// are still in use are closed once they are released). A ReopenCache is safe
+// for concurrent use.
+//
+// [os.File.Close]: https://pkg.go.dev/os#File.Close
+// [os.File.ReadAt]: https://pkg.go.dev/os#File.ReadAt
+type ReopenCache struct {
+	mu      sync.Mutex
+	maxOpen int
+	lru     *list.List // of *reopenEntry, most-recently-used first
+	entries map[reopenKey]*reopenEntry
+	files   map[*os.File]*reopenEntry
+}
+
+// NewReopenCache creates a new [ReopenCache] which keeps at most maxOpen
+// files open. If all of the cached files are in use when a new file needs to
+// be opened, the new file is not cached (it is still returned, and is closed
+// once it is released), so the cache itself never exceeds maxOpen file
+// descriptors. If maxOpen is not positive, no files are cached.
+func NewReopenCache(maxOpen int) *ReopenCache {
+	return &ReopenCache{
+		maxOpen: maxOpen,
+		lru:     list.New(),
+		entries: make(map[reopenKey]*reopenEntry),
+		files:   make(map[*os.File]*reopenEntry),
+	}
+}
+
+// Reopen returns a file for the [Handle] re-opened with the given flags (see
+// [Handle.Reopen]), re-using a cached file if the [Handle] has already been
+// re-opened with the same flags. The returned file must be released with
+// [ReopenCache.Release] once it is no longer needed.
+func (c *ReopenCache) Reopen(h *Handle, flags int) (*os.File, error) {
+	key := reopenKey{handle: h, flags: flags}
+
+	c.mu.Lock()
+	if entry, ok := c.entries[key]; ok {
+		entry.refs++
+		c.lru.MoveToFront(entry.elem)
+		c.mu.Unlock()
+		return entry.file, nil
+	}
+	c.mu.Unlock()
+
+	// Don't hold the lock while opening the file, as it could block (such as
+	// when opening a FIFO).
+	file, err := h.Reopen(flags)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Someone else might have re-opened the same file in the meantime.
+	if entry, ok := c.entries[key]; ok {
+		_ = file.Close()
+		entry.refs++
+		c.lru.MoveToFront(entry.elem)
+		return entry.file, nil
+	}
+
+	entry := &reopenEntry{key: key, file: file, refs: 1}
+	c.files[file] = entry
+	if c.makeRoom() && h.addCloseHook(c, func() { c.invalidate(h) }) {
+		entry.elem = c.lru.PushFront(entry)
+		c.entries[key] = entry
+	}
+	return file, nil
+}
+
+// Release releases a reference to a file returned by [ReopenCache.Reopen]. If
+// the file is no longer cached (because it was evicted, or its [Handle] was
+// closed) and this was the last reference, the file is closed. Releasing a
+// file that did not come from the cache (or releasing it more times than it
+// was returned by [ReopenCache.Reopen]) results in an error.
+func (c *ReopenCache) Release(file *os.File) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.files[file]
+	if !ok || entry.refs == 0 {
+		return errors.New("file was not returned by this cache or has already been released")
+	}
+	entry.refs--
+	if entry.refs > 0 || entry.elem != nil {
+		return nil
+	}
+	delete(c.files, file)
+	return file.Close()
+}
+
+// Close evicts every file from the cache. Unused files are closed
+// immediately, while files which are still in use are closed once they are
+// released. The cache can continue to be used after Close.
+func (c *ReopenCache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var errs []error
+	for c.lru.Len() > 0 {
+		if err := c.evict(c.lru.Back().Value.(*reopenEntry)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// makeRoom evicts unused entries until there is room for a new entry, and
+// returns false if that was not possible. c.mu must be held.
+func (c *ReopenCache) makeRoom() bool {
+	for len(c.entries) >= c.maxOpen {
+		var victim *reopenEntry
+		for elem := c.lru.Back(); elem != nil; elem = elem.Prev() {
+			if entry := elem.Value.(*reopenEntry); entry.refs == 0 {
+				victim = entry
+				break
+			}
+		}
+		if victim == nil {
+			return false
+		}
+		_ = c.evict(victim)
+	}
+	return true
+}
+
+// invalidate evicts all of the entries for h. c.mu must not be held.
+func (c *ReopenCache) invalidate(h *Handle) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, entry := range c.entries {
+		if key.handle == h {
+			_ = c.evict(entry)
+		}
+	}
+}
+
+// evict removes entry from the cache, closing its file if it is unused.
+// c.mu must be held.
+func (c *ReopenCache) evict(entry *reopenEntry) error {
+	c.lru.Remove(entry.elem)
+	entry.elem = nil
+	delete(c.entries, entry.key)
+
+	// Stop tracking the Handle if this was its last cached file.
+	handle := entry.key.handle
+	lastForHandle := true
+	for key := range c.entries {
+		if key.handle == handle {
+			lastForHandle = false
+			break
+		}
+	}
+	if lastForHandle {
+		handle.removeCloseHook(c)
+	}
+
+	if entry.refs > 0 {
+		return nil
+	}
+	delete(c.files, entry.file)
+	return entry.file.Close()
+}
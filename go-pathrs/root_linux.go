@@ -21,10 +21,24 @@
 package pathrs
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
 )
 
 // Root is a handle to the root of a directory tree to resolve within. The only
@@ -36,21 +50,113 @@ import (
 // protections that should defend against it, it's far more dangerous than just
 // opening a directory tree which is not inside a potentially-untrusted
 // directory.
+//
+// It is safe to use a [Root] from multiple goroutines concurrently (including
+// calling [Root.Close] while other operations are in-flight). Operations
+// started after [Root.Close] fail with an error wrapping [ErrClosed].
 type Root struct {
-	inner *os.File
+	inner   *os.File
+	closed  atomic.Bool
+	timeout atomic.Int64 // time.Duration
 }
 
 // OpenRoot creates a new [Root] handle to the directory at the given path.
+//
+// This is equivalent to [OpenRootWithOptions] with no options.
 func OpenRoot(path string) (*Root, error) {
-	fd, err := pathrsOpenRoot(path)
+	return OpenRootWithOptions(path)
+}
+
+// RootOption is an option for [OpenRootWithOptions].
+type RootOption func(*rootOptions)
+
+type rootOptions struct {
+	noFollowTrailing bool
+	timeout          time.Duration
+}
+
+// WithNoFollowTrailing causes [OpenRootWithOptions] to fail (with ENOTDIR) if
+// the final component of the path is a symlink, rather than opening the
+// symlink's target as the [Root].
+func WithNoFollowTrailing() RootOption {
+	return func(opts *rootOptions) {
+		opts.noFollowTrailing = true
+	}
+}
+
+// WithDefaultTimeout causes [OpenRootWithOptions] to set the default timeout
+// of the new [Root], as with [Root.SetDefaultTimeout].
+func WithDefaultTimeout(d time.Duration) RootOption {
+	return func(opts *rootOptions) {
+		opts.timeout = d
+	}
+}
+
+// OpenRootWithOptions creates a new [Root] handle to the directory at the given
+// path, configured with the given options. The path itself is resolved on the
+// host (it is not resolved safely) -- it is only paths within the [Root] that
+// are protected by libpathrs.
+func OpenRootWithOptions(path string, opts ...RootOption) (*Root, error) {
+	var options rootOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	var (
+		fd  uintptr
+		err error
+	)
+	if options.noFollowTrailing {
+		fd, err = openRootNoFollow(path)
+	} else {
+		fd, err = pathrsOpenRoot(path)
+	}
 	if err != nil {
 		return nil, err
 	}
-	file, err := mkFile(fd)
+	root := newRoot(mkFile(fd))
+	root.timeout.Store(int64(options.timeout))
+	return root, nil
+}
+
+// openRootNoFollow opens the parent directory of path with libpathrs and then
+// resolves the final component inside it without following it, so that a
+// trailing symlink results in ENOTDIR.
+func openRootNoFollow(path string) (uintptr, error) {
+	dir, name := filepath.Split(strings.TrimRight(path, "/"))
+	if name == "" || name == "." || name == ".." {
+		// There is no final component which could be a symlink.
+		return pathrsOpenRoot(path)
+	}
+	if dir == "" {
+		dir = "."
+	}
+
+	parentFd, err := pathrsOpenRoot(dir)
 	if err != nil {
-		return nil, err
+		return 0, err
+	}
+	defer unix.Close(int(parentFd))
+
+	fd, err := pathrsInRootResolveNoFollow(parentFd, name)
+	if err != nil {
+		return 0, err
+	}
+	var stat unix.Stat_t
+	if err := unix.Fstat(int(fd), &stat); err != nil {
+		_ = unix.Close(int(fd))
+		return 0, fmt.Errorf("fstat root %s: %w", path, err)
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFDIR {
+		_ = unix.Close(int(fd))
+		return 0, &Error{
+			Errno:       unix.ENOTDIR,
+			Op:          "open_root",
+			Path:        path,
+			Description: "root path is not a directory (or is a trailing symlink)",
+		}
 	}
-	return &Root{inner: file}, nil
+	return fd, nil
 }
 
 // RootFromFile creates a new [Root] handle from an [os.File] referencing a
@@ -65,7 +171,172 @@ func RootFromFile(file *os.File) (*Root, error) {
 	if err != nil {
 		return nil, fmt.Errorf("duplicate root fd: %w", err)
 	}
-	return &Root{inner: newFile}, nil
+	return newRoot(newFile), nil
+}
+
+// RootFromFd creates a new [Root] handle from a file descriptor referencing a
+// directory, such as one received with SCM_RIGHTS or through systemd file
+// descriptor passing. The file descriptor is checked with fstat(2) to make
+// sure it references a directory, otherwise an error wrapping ENOTDIR is
+// returned.
+//
+// If takeOwnership is true, the [Root] adopts the file descriptor and it is
+// closed when the [Root] is closed. Otherwise, the file descriptor is
+// duplicated and the caller remains responsible for closing the original. If
+// an error is returned, ownership of the file descriptor is never taken.
+func RootFromFd(fd uintptr, takeOwnership bool) (*Root, error) {
+	var stat unix.Stat_t
+	if err := unix.Fstat(int(fd), &stat); err != nil {
+		return nil, fmt.Errorf("fstat root fd %d: %w", fd, err)
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFDIR {
+		return nil, fmt.Errorf("root fd %d: %w", fd, unix.ENOTDIR)
+	}
+
+	if !takeOwnership {
+		file, err := dupFd(fd, fdName(fd))
+		if err != nil {
+			return nil, fmt.Errorf("duplicate root fd: %w", err)
+		}
+		return newRoot(file), nil
+	}
+	return newRoot(mkFile(fd)), nil
+}
+
+// RootFromMountFd creates a new [Root] handle from a file descriptor
+// referencing a mount, such as one returned by open_tree(2) or fsmount(2).
+// This includes detached mounts (created with OPEN_TREE_CLONE or fsmount(2))
+// which have not yet been attached to the mount namespace with
+// move_mount(2), since libpathrs operations never need to look up the
+// [Root]'s path.
+//
+// The file descriptor must reference the root of a mount (on kernels older
+// than Linux 5.8, which do not support STATX_ATTR_MOUNT_ROOT, this is not
+// checked), otherwise an error wrapping EINVAL is returned. If the mount is
+// not a directory (because it is a bind-mount of a file), an error wrapping
+// ENOTDIR is returned, as such mounts cannot be used as a [Root].
+//
+// The file descriptor is duplicated, so the caller remains responsible for
+// closing the original (and can still use it with move_mount(2)).
+func RootFromMountFd(fd int) (*Root, error) {
+	var stx unix.Statx_t
+	err := unix.Statx(fd, "", unix.AT_EMPTY_PATH|unix.AT_SYMLINK_NOFOLLOW, unix.STATX_TYPE, &stx)
+	switch {
+	case errors.Is(err, unix.ENOSYS):
+		// statx(2) is not supported, so we can't check STATX_ATTR_MOUNT_ROOT.
+		return RootFromFd(uintptr(fd), false)
+	case err != nil:
+		return nil, fmt.Errorf("statx mount fd %d: %w", fd, err)
+	}
+
+	if stx.Mode&unix.S_IFMT != unix.S_IFDIR {
+		return nil, fmt.Errorf("mount fd %d is not a directory: %w", fd, unix.ENOTDIR)
+	}
+	if stx.Attributes_mask&unix.STATX_ATTR_MOUNT_ROOT != 0 && stx.Attributes&unix.STATX_ATTR_MOUNT_ROOT == 0 {
+		return nil, fmt.Errorf("mount fd %d is not the root of a mount: %w", fd, unix.EINVAL)
+	}
+	return RootFromFd(uintptr(fd), false)
+}
+
+// SetDefaultTimeout sets a timeout that is applied to every libpathrs
+// operation done through the [Root] (such as [Root.Resolve], [Root.Create],
+// or [Root.Mkdir], as well as methods which are built on top of them), as a
+// lighter-weight alternative to [Root.ResolveContext] for programs that do not
+// have a [context.Context] available. If an operation does not complete
+// within the timeout, an error wrapping [context.DeadlineExceeded] is
+// returned. A timeout of zero (the default) disables the timeout.
+//
+// The same limitations as [Root.ResolveContext] apply: a syscall blocked in
+// the kernel cannot be interrupted, so the operation will continue in the
+// background until it completes, at which point any resulting file
+// descriptor is closed. Operations that complete before the timeout do not
+// leave any goroutines behind. [Root.ResolveMany] is not affected by the
+// timeout.
+//
+// [context.Context]: https://pkg.go.dev/context#Context
+// [context.DeadlineExceeded]: https://pkg.go.dev/context#DeadlineExceeded
+func (r *Root) SetDefaultTimeout(d time.Duration) {
+	r.timeout.Store(int64(d))
+}
+
+// withRootFd is like withFileFd for the [Root]'s file descriptor, except that
+// the default timeout of the [Root] (if any) is applied. If the operation
+// times out, the result of fn is closed once it completes (if it is an
+// [io.Closer]). ENOTDIR errors are converted with [notDirError] (within the
+// same timeout).
+func withRootFd[T any](r *Root, fn func(rootFd uintptr) (T, error)) (T, error) {
+	op := func() (T, error) {
+		return withFileFd(r.inner, func(rootFd uintptr) (T, error) {
+			val, err := fn(rootFd)
+			return val, notDirError(rootFd, err)
+		})
+	}
+
+	timeout := time.Duration(r.timeout.Load())
+	if timeout <= 0 {
+		return op()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// The entire withFileFd call runs on the other goroutine, so that the
+	// root fd stays borrowed (and thus cannot be closed and re-used) until
+	// the libpathrs call eventually returns.
+	return withContext(ctx, op, func(val T) {
+		if closer, ok := any(val).(io.Closer); ok {
+			_ = closer.Close()
+		}
+	})
+}
+
+// notDirError converts an ENOTDIR [Error] from an operation on the root at
+// rootFd into a [NotDirError], by resolving each leading part of the error's
+// path to find the first one that is not a directory. The final component is
+// only checked if the path has a trailing slash, as otherwise ENOTDIR for the
+// final component is just a normal error (such as when calling rmdir on a
+// file). If no such component can be found, err is returned unchanged.
+func notDirError(rootFd uintptr, err error) error {
+	var perr *Error
+	if !errors.As(err, &perr) || perr.Errno != unix.ENOTDIR || perr.Path == "" {
+		return err
+	}
+
+	trimmed := strings.TrimRight(perr.Path, "/")
+	parts := strings.Split(trimmed, "/")
+	numParts := len(parts) - 1
+	if trimmed != perr.Path {
+		numParts = len(parts)
+	}
+	for i := 0; i < numParts; i++ {
+		if parts[i] == "" || parts[i] == "." {
+			continue
+		}
+		prefix := strings.Join(parts[:i+1], "/")
+		isDir, statErr := isDirAt(rootFd, prefix)
+		if statErr != nil {
+			break
+		}
+		if !isDir {
+			return &NotDirError{Err: perr, Component: prefix}
+		}
+	}
+	return err
+}
+
+// isDirAt returns whether path (resolved within the root) is a directory.
+func isDirAt(rootFd uintptr, path string) (bool, error) {
+	fd, err := pathrsInRootResolve(rootFd, path)
+	if err != nil {
+		return false, err
+	}
+	defer unix.Close(int(fd))
+
+	var stat unix.Stat_t
+	if err := unix.Fstat(int(fd), &stat); err != nil {
+		return false, err
+	}
+	return stat.Mode&unix.S_IFMT == unix.S_IFDIR, nil
 }
 
 // Resolve resolves the given path within the [Root]'s directory tree, and
@@ -74,260 +345,1792 @@ func RootFromFile(file *os.File) (*Root, error) {
 //
 // All symlinks (including trailing symlinks) are followed, but they are
 // resolved within the rootfs. If you wish to open a handle to the symlink
-// itself, use [ResolveNoFollow].
+// itself, use [Root.ResolveNoFollow].
 func (r *Root) Resolve(path string) (*Handle, error) {
-	return withFileFd(r.inner, func(rootFd uintptr) (*Handle, error) {
+	handle, err := withRootFd(r, func(rootFd uintptr) (*Handle, error) {
 		handleFd, err := pathrsInRootResolve(rootFd, path)
 		if err != nil {
 			return nil, err
 		}
-		handleFile, err := mkFile(handleFd)
-		if err != nil {
-			return nil, err
-		}
-		return &Handle{inner: handleFile}, nil
+		return newHandle(mkFile(handleFd)), nil
 	})
+	auditHandle("resolve", path, handle, err)
+	return handle, err
 }
 
-// ResolveNoFollow is effectively an O_NOFOLLOW version of [Resolve]. Their
-// behaviour is identical, except that *trailing* symlinks will not be
+// ResolveNoFollow is effectively an O_NOFOLLOW version of [Root.Resolve].
+// Their behaviour is identical, except that *trailing* symlinks will not be
 // followed. If the final component is a trailing symlink, an O_PATH|O_NOFOLLOW
 // handle to the symlink itself is returned.
+//
+// Symlinks in any of the intermediate path components are still followed
+// (within the rootfs), so this cannot be used to escape the [Root].
 func (r *Root) ResolveNoFollow(path string) (*Handle, error) {
-	return withFileFd(r.inner, func(rootFd uintptr) (*Handle, error) {
+	handle, err := withRootFd(r, func(rootFd uintptr) (*Handle, error) {
 		handleFd, err := pathrsInRootResolveNoFollow(rootFd, path)
 		if err != nil {
 			return nil, err
 		}
-		handleFile, err := mkFile(handleFd)
-		if err != nil {
-			return nil, err
-		}
-		return &Handle{inner: handleFile}, nil
+		return newHandle(mkFile(handleFd)), nil
 	})
+	auditHandle("resolve_nofollow", path, handle, err)
+	return handle, err
 }
 
-// Open is effectively shorthand for [Resolve] followed by [Handle.Open], but
-// can be slightly more efficient (it reduces CGo overhead and the number of
-// syscalls used when using the openat2-based resolver) and is arguably more
-// ergonomic to use.
+// ResolveParent resolves the parent directory of the given path within the
+// [Root]'s directory tree, and returns a [Handle] to the parent directory
+// along with the (unresolved) final component of the path. This is useful for
+// doing *at(2)-style operations relative to a trusted directory handle.
 //
-// This is effectively equivalent to [os.Open].
-//
-// [os.Open]: https://pkg.go.dev/os#Open
-func (r *Root) Open(path string) (*os.File, error) {
-	return r.OpenFile(path, os.O_RDONLY)
+// Trailing slashes are ignored (so "foo/bar/" results in a handle to "foo"
+// and the name "bar"). If the final component is "." or ".." (or the path has
+// no final component at all, such as "/"), an EINVAL error is returned. If
+// the parent path exists but is not a directory, a [NotDirError] (wrapping
+// ENOTDIR) is returned.
+func (r *Root) ResolveParent(path string) (*Handle, string, error) {
+	dir, name := filepath.Split(strings.TrimRight(path, "/"))
+	if name == "" || name == "." || name == ".." {
+		return nil, "", &Error{
+			Errno:       unix.EINVAL,
+			Op:          "resolve_parent",
+			Path:        path,
+			Description: "path has no final component that can be resolved separately",
+		}
+	}
+	if dir == "" {
+		dir = "."
+	}
+
+	handle, err := r.Resolve(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	info, err := handle.Stat()
+	if err != nil {
+		_ = handle.Close()
+		return nil, "", fmt.Errorf("stat parent directory: %w", err)
+	}
+	if !info.IsDir() {
+		_ = handle.Close()
+		return nil, "", &NotDirError{
+			Err: &Error{
+				Errno:       unix.ENOTDIR,
+				Op:          "resolve_parent",
+				Path:        path,
+				Description: "parent path is not a directory",
+			},
+			Component: strings.TrimRight(dir, "/"),
+		}
+	}
+	return handle, name, nil
 }
 
-// OpenFile is effectively shorthand for [Resolve] followed by
-// [Handle.OpenFile], but can be slightly more efficient (it reduces CGo
-// overhead and the number of syscalls used when using the openat2-based
-// resolver) and is arguably more ergonomic to use.
-//
-// However, if flags contains os.O_NOFOLLOW and the path is a symlink, then
-// OpenFile's behaviour will match that of openat2. In most cases an error will
-// be returned, but if os.O_PATH is provided along with os.O_NOFOLLOW then a
-// file equivalent to [ResolveNoFollow] will be returned instead.
+// ResolveComponents resolves each successive prefix of the given path within
+// the [Root]'s directory tree, and returns a [Handle] for each of them in
+// order, starting with the top of the [Root] itself. For instance, "a/b/c"
+// results in handles to ".", "a", "a/b", and "a/b/c". This is useful for
+// tools that need to verify the ownership or mode of every directory along a
+// path. All symlinks (including trailing symlinks) are followed within the
+// rootfs, and every handle but the last is guaranteed to be a directory.
 //
-// This is effectively equivalent to [os.OpenFile], except that os.O_CREAT is
-// not supported.
+// Each prefix is resolved separately, so if an attacker is modifying the tree
+// concurrently the handles may not all refer to the same traversal. However,
+// every handle is still guaranteed to be inside the [Root].
 //
-// [os.OpenFile]: https://pkg.go.dev/os#OpenFile
-func (r *Root) OpenFile(path string, flags int) (*os.File, error) {
-	return withFileFd(r.inner, func(rootFd uintptr) (*os.File, error) {
-		fd, err := pathrsInRootOpen(rootFd, path, flags)
+// One file descriptor is held for each path component, so callers should be
+// careful when resolving very deep paths (using [CloseAll] to close all of
+// the handles once they are done with them). On error, all handles are
+// closed and no handles are returned.
+func (r *Root) ResolveComponents(path string) ([]*Handle, error) {
+	var prefixes []string
+	for _, part := range strings.Split(path, "/") {
+		if part == "" || part == "." {
+			continue
+		}
+		prefix := part
+		if len(prefixes) > 0 {
+			prefix = prefixes[len(prefixes)-1] + "/" + part
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	handles := make([]*Handle, 0, len(prefixes)+1)
+	closeAll := func() {
+		for _, handle := range handles {
+			_ = handle.Close()
+		}
+	}
+
+	root, err := r.OpenRootHandle()
+	if err != nil {
+		return nil, err
+	}
+	handles = append(handles, root)
+
+	for i, prefix := range prefixes {
+		handle, err := r.Resolve(prefix)
 		if err != nil {
+			closeAll()
 			return nil, err
 		}
-		return mkFile(fd)
-	})
+		handles = append(handles, handle)
+		if i < len(prefixes)-1 {
+			if err := checkDirHandle("resolve_components", handle); err != nil {
+				closeAll()
+				return nil, err
+			}
+		}
+	}
+	return handles, nil
 }
 
-// Create creates a file within the [Root]'s directory tree at the given path,
-// and returns a handle to the file. The provided mode is used for the new file
-// (the process's umask applies).
+// OpenRootHandle returns a [Handle] to the top of the [Root]'s directory tree
+// (equivalent to calling [Root.Resolve] with "."). This allows the root
+// directory itself to be operated on in the same way as any other path, such
+// as with [Handle.Stat] or [Handle.ReadDir].
 //
-// Unlike [os.Create], if the file already exists an error is created rather
-// than the file being opened and truncated.
+// Unlike [Root.IntoFile] (which returns the [Root]'s own file descriptor), the
+// returned [Handle] is a new file descriptor that is independent of the
+// [Root] and must be closed separately with [Handle.Close].
+func (r *Root) OpenRootHandle() (*Handle, error) {
+	return r.Resolve(".")
+}
+
+// ResolveContext is identical to [Root.Resolve], except that the operation is
+// abandoned if ctx is cancelled before it completes (in which case ctx.Err()
+// is returned). If ctx has already been cancelled, the filesystem is not
+// touched at all.
 //
-// [os.Create]: https://pkg.go.dev/os#Create
-func (r *Root) Create(path string, flags int, mode os.FileMode) (*os.File, error) {
-	unixMode, err := toUnixMode(mode)
-	if err != nil {
+// Note that it is not possible to interrupt a syscall that is blocked inside
+// the kernel (such as a lookup on a hung NFS mount), so cancellation only
+// causes ResolveContext to return early. The in-flight resolution will
+// continue in the background until the kernel returns, at which point any
+// resulting [Handle] is closed automatically. As a result, a goroutine and
+// (for a short time) a file descriptor may outlive the call.
+func (r *Root) ResolveContext(ctx context.Context, path string) (*Handle, error) {
+	return withContext(ctx, func() (*Handle, error) {
+		return r.Resolve(path)
+	}, func(h *Handle) { _ = h.Close() })
+}
+
+// ResolveNoFollowContext is identical to [Root.ResolveNoFollow], except that
+// the operation is abandoned if ctx is cancelled before it completes. See
+// [Root.ResolveContext] for the limitations of cancellation.
+func (r *Root) ResolveNoFollowContext(ctx context.Context, path string) (*Handle, error) {
+	return withContext(ctx, func() (*Handle, error) {
+		return r.ResolveNoFollow(path)
+	}, func(h *Handle) { _ = h.Close() })
+}
+
+// ResolveAt resolves the given path relative to the directory referenced by
+// dir, and returns a [Handle] to the resolved path. This avoids re-resolving
+// the path to dir from the top of a [Root] when doing many lookups deep inside
+// a directory tree. All symlinks (including trailing symlinks) are followed.
+//
+// The resolution is done as though dir were the root of a [Root], so the
+// result can never be outside of dir. Note that this means absolute symlinks
+// (and ".." components inside symlinks) are resolved relative to dir rather
+// than the [Root] that dir was resolved from. If path itself has ".."
+// components that would climb above dir, an error wrapping EXDEV is returned
+// rather than the ".." being silently clamped to dir. If dir is not a
+// directory, an error wrapping ENOTDIR is returned.
+func ResolveAt(dir *Handle, path string) (*Handle, error) {
+	if err := checkDirHandle("resolve_at", dir); err != nil {
 		return nil, err
 	}
-	return withFileFd(r.inner, func(rootFd uintptr) (*os.File, error) {
-		handleFd, err := pathrsInRootCreat(rootFd, path, flags, unixMode)
+	if clean := filepath.Clean(path); !filepath.IsAbs(clean) &&
+		(clean == ".." || strings.HasPrefix(clean, "../")) {
+		return nil, &Error{
+			Errno:       unix.EXDEV,
+			Op:          "resolve_at",
+			Path:        path,
+			Description: "path would escape the directory it is resolved relative to",
+		}
+	}
+
+	handle, err := withFileFd(dir.inner, func(dirFd uintptr) (*Handle, error) {
+		handleFd, err := pathrsInRootResolve(dirFd, path)
 		if err != nil {
 			return nil, err
 		}
-		return mkFile(handleFd)
+		return newHandle(mkFile(handleFd)), nil
 	})
+	auditHandle("resolve_at", path, handle, err)
+	return handle, err
 }
 
-// Rename two paths within a [Root]'s directory tree. The flags argument is
-// identical to the RENAME_* flags to the renameat2(2) system call.
-func (r *Root) Rename(src, dst string, flags uint) error {
-	_, err := withFileFd(r.inner, func(rootFd uintptr) (struct{}, error) {
-		err := pathrsInRootRename(rootFd, src, dst, flags)
-		return struct{}{}, err
-	})
-	return err
-}
+// ResolveMany is equivalent to calling [Root.Resolve] on each of the given
+// paths, but amortises the per-call overhead of doing so (the [Root]'s file
+// descriptor is only borrowed once, and the handle to procfs and scratch
+// buffer used to look up the name of each [Handle] are re-used). This makes a
+// noticeable difference when resolving a large number of paths.
+//
+// The returned slices are the same length as paths. For each index i, either
+// handles[i] is a valid [Handle] (which the caller must close) and errs[i] is
+// nil, or handles[i] is nil and errs[i] describes why paths[i] could not be
+// resolved. An error resolving one path does not stop the others from being
+// resolved.
+func (r *Root) ResolveMany(paths []string) (handles []*Handle, errs []error) {
+	handles = make([]*Handle, len(paths))
+	errs = make([]error, len(paths))
 
-// RemoveDir removes the named empty directory within a [Root]'s directory
-// tree.
-func (r *Root) RemoveDir(path string) error {
+	var fallback bool
 	_, err := withFileFd(r.inner, func(rootFd uintptr) (struct{}, error) {
-		err := pathrsInRootRmdir(rootFd, path)
-		return struct{}{}, err
-	})
-	return err
-}
+		procFdDir, closer, err := ProcThreadSelfOpen("fd/", unix.O_PATH|unix.O_DIRECTORY)
+		if err != nil {
+			// Without procfs there is nothing to amortise, so just fall back
+			// to resolving each path individually.
+			fallback = true
+			for i, path := range paths {
+				handles[i], errs[i] = r.Resolve(path)
+			}
+			return struct{}{}, nil
+		}
+		defer closer()
+		defer procFdDir.Close()
 
-// RemoveFile removes the named file within a [Root]'s directory tree.
-func (r *Root) RemoveFile(path string) error {
-	_, err := withFileFd(r.inner, func(rootFd uintptr) (struct{}, error) {
-		err := pathrsInRootUnlink(rootFd, path)
-		return struct{}{}, err
+		return withFileFd(procFdDir, func(procFd uintptr) (struct{}, error) {
+			var buf []byte
+			for i, path := range paths {
+				handleFd, err := pathrsInRootResolve(rootFd, path)
+				if err != nil {
+					errs[i] = err
+					continue
+				}
+				name, err := procFdName(procFd, handleFd, &buf)
+				if err != nil {
+					name = fallbackFdName(handleFd)
+				}
+				handles[i] = newHandle(os.NewFile(handleFd, name))
+			}
+			return struct{}{}, nil
+		})
 	})
-	return err
-}
-
-// Remove removes the named file or (empty) directory within a [Root]'s
-// directory tree.
-//
-// This is effectively equivalent to [os.Remove].
-//
-// [os.Remove]: https://pkg.go.dev/os#Remove
-func (r *Root) Remove(path string) error {
-	// In order to match os.Remove's implementation we need to also do both
-	// syscalls unconditionally and adjust the error based on whether
-	// pathrs_inroot_rmdir() returned ENOTDIR.
-	unlinkErr := r.RemoveFile(path)
-	if unlinkErr == nil {
-		return nil
-	}
-	rmdirErr := r.RemoveDir(path)
-	if rmdirErr == nil {
-		return nil
+	if err != nil {
+		for i := range errs {
+			if handles[i] == nil && errs[i] == nil {
+				errs[i] = err
+			}
+		}
 	}
-	// Both failed, adjust the error in the same way that os.Remove does.
-	err := rmdirErr
-	if errors.Is(err, syscall.ENOTDIR) {
-		err = unlinkErr
+	// Resolve has already called the audit hook in the fallback case.
+	if !fallback {
+		for i, path := range paths {
+			auditHandle("resolve", path, handles[i], errs[i])
+		}
 	}
-	return err
+	return handles, errs
 }
 
-// RemoveAll recursively deletes a path and all of its children.
+// Readlink returns the target of the symlink at the given path within the
+// [Root]'s directory tree. All path components except the final one are
+// resolved (within the rootfs), and the final component must be a symlink
+// (otherwise EINVAL is returned).
 //
-// This is effectively equivalent to [os.RemoveAll].
+// The returned target is the raw contents of the symlink, so it must not be
+// used for further lookups outside of libpathrs.
 //
-// [os.RemoveAll]: https://pkg.go.dev/os#RemoveAll
-func (r *Root) RemoveAll(path string) error {
-	_, err := withFileFd(r.inner, func(rootFd uintptr) (struct{}, error) {
-		err := pathrsInRootRemoveAll(rootFd, path)
-		return struct{}{}, err
+// This is effectively equivalent to [os.Readlink].
+//
+// [os.Readlink]: https://pkg.go.dev/os#Readlink
+func (r *Root) Readlink(path string) (string, error) {
+	return withRootFd(r, func(rootFd uintptr) (string, error) {
+		return pathrsInRootReadlink(rootFd, path)
 	})
-	return err
 }
 
-// Mkdir creates a directory within a [Root]'s directory tree. The provided
-// mode is used for the new directory (the process's umask applies).
+// Stat returns the [os.FileInfo] describing the file at the given path within
+// the [Root]'s directory tree. All symlinks (including trailing symlinks) are
+// followed within the rootfs.
 //
-// This is effectively equivalent to [os.Mkdir].
+// This is effectively equivalent to [os.Stat].
 //
-// [os.Mkdir]: https://pkg.go.dev/os#Mkdir
-func (r *Root) Mkdir(path string, mode os.FileMode) error {
-	unixMode, err := toUnixMode(mode)
+// [os.FileInfo]: https://pkg.go.dev/os#FileInfo
+// [os.Stat]: https://pkg.go.dev/os#Stat
+func (r *Root) Stat(path string) (os.FileInfo, error) {
+	handle, err := r.Resolve(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer handle.Close()
 
-	_, err = withFileFd(r.inner, func(rootFd uintptr) (struct{}, error) {
-		err := pathrsInRootMkdir(rootFd, path, unixMode)
-		return struct{}{}, err
-	})
-	return err
+	return handle.Stat()
 }
 
-// MkdirAll creates a directory (and any parent path components if they don't
-// exist) within a [Root]'s directory tree. The provided mode is used for any
-// directories created by this function (the process's umask applies).
+// Lstat is identical to [Root.Stat], except that trailing symlinks are not
+// followed (if the final component is a symlink, the returned [os.FileInfo]
+// describes the symlink itself and has [os.ModeSymlink] set).
 //
-// This is effectively equivalent to [os.MkdirAll].
+// This is effectively equivalent to [os.Lstat].
 //
-// [os.MkdirAll]: https://pkg.go.dev/os#MkdirAll
-func (r *Root) MkdirAll(path string, mode os.FileMode) (*Handle, error) {
-	unixMode, err := toUnixMode(mode)
+// [os.FileInfo]: https://pkg.go.dev/os#FileInfo
+// [os.ModeSymlink]: https://pkg.go.dev/os#ModeSymlink
+// [os.Lstat]: https://pkg.go.dev/os#Lstat
+func (r *Root) Lstat(path string) (os.FileInfo, error) {
+	handle, err := r.ResolveNoFollow(path)
 	if err != nil {
 		return nil, err
 	}
+	defer handle.Close()
 
-	return withFileFd(r.inner, func(rootFd uintptr) (*Handle, error) {
-		handleFd, err := pathrsInRootMkdirAll(rootFd, path, unixMode)
-		if err != nil {
-			return nil, err
+	return handle.Stat()
+}
+
+// listDirBatchSize is the number of directory entries read at a time by
+// [Root.ListDir] and [Root.CountEntries].
+const listDirBatchSize = 1024
+
+// ListDir returns the names of all of the entries in the directory at the
+// given path within the [Root]'s directory tree, sorted lexically. The "."
+// and ".." entries are not included. All symlinks (including trailing
+// symlinks) are followed within the rootfs. If the path is not a directory,
+// an error wrapping ENOTDIR is returned.
+//
+// The directory is read in batches, so the memory used (apart from the
+// returned names) is bounded even for very large directories.
+func (r *Root) ListDir(path string) ([]string, error) {
+	dir, err := r.OpenFile(path, os.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+
+	var names []string
+	for {
+		batch, err := dir.Readdirnames(listDirBatchSize)
+		names = append(names, batch...)
+		if errors.Is(err, io.EOF) {
+			break
 		}
-		handleFile, err := mkFile(handleFd)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("list directory %s: %w", path, err)
 		}
-		return &Handle{inner: handleFile}, err
-	})
+	}
+	sort.Strings(names)
+	return names, nil
 }
 
-// Mknod creates a new device inode of the given type within a [Root]'s
-// directory tree. The provided mode is used for the new directory (the
-// process's umask applies).
-//
-// This is effectively equivalent to [unix.Mknod].
+// CountEntries returns the number of entries (excluding "." and "..") in the
+// directory at the given path within the [Root]'s directory tree. All
+// symlinks (including trailing symlinks) are followed within the rootfs.
 //
-// [unix.Mknod]: https://pkg.go.dev/golang.org/x/sys/unix#Mknod
-func (r *Root) Mknod(path string, mode os.FileMode, dev uint64) error {
-	unixMode, err := toUnixMode(mode)
+// Unlike [Root.ListDir], the entries are counted as the directory is read
+// (in batches of the same size as [Root.ListDir]) rather than collected, so
+// memory usage does not depend on the size of the directory. If the
+// directory is modified concurrently, the count may not reflect any single
+// state of the directory.
+func (r *Root) CountEntries(path string) (int, error) {
+	dir, err := r.OpenFile(path, os.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer dir.Close()
+
+	var count int
+	for {
+		batch, err := dir.Readdirnames(listDirBatchSize)
+		count += len(batch)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("count directory entries %s: %w", path, err)
+		}
+	}
+	return count, nil
+}
+
+// SyncDir commits the directory at the given path within the [Root]'s
+// directory tree to stable storage using fsync(2), so that changes to the
+// directory entries (such as files created or renamed into it) are durable.
+// All symlinks (including trailing symlinks) are followed within the rootfs.
+// If the path is not a directory, an error wrapping ENOTDIR is returned.
+func (r *Root) SyncDir(path string) error {
+	handle, err := r.Resolve(path)
 	if err != nil {
 		return err
 	}
+	defer handle.Close()
 
-	_, err = withFileFd(r.inner, func(rootFd uintptr) (struct{}, error) {
-		err := pathrsInRootMknod(rootFd, path, unixMode, dev)
-		return struct{}{}, err
-	})
-	return err
+	return handle.sync(os.O_RDONLY|unix.O_DIRECTORY, unix.Fsync, "fsync")
 }
 
-// Symlink creates a symlink within a [Root]'s directory tree. The symlink is
-// created at path and is a link to target.
-//
-// This is effectively equivalent to [os.Symlink].
-//
+// Exists returns whether a file exists at the given path within the [Root]'s
+// directory tree. All symlinks (including trailing symlinks) are followed
+// within the rootfs, so a dangling symlink does not exist. If the path (or one
+// of its parent components) does not exist, or one of the parent components
+// is not a directory, (false, nil) is returned. Any other error (such as
+// EACCES) is returned as-is.
+func (r *Root) Exists(path string) (bool, error) {
+	handle, err := r.Resolve(path)
+	if err != nil {
+		if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ENOTDIR) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, handle.Close()
+}
+
+// IsDir returns whether the given path within the [Root]'s directory tree is
+// a directory. All symlinks (including trailing symlinks) are followed within
+// the rootfs. As with [Root.Exists], if the path does not exist (false, nil)
+// is returned.
+func (r *Root) IsDir(path string) (bool, error) {
+	info, err := r.Stat(path)
+	if err != nil {
+		if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ENOTDIR) {
+			return false, nil
+		}
+		return false, err
+	}
+	return info.IsDir(), nil
+}
+
+// SameFile returns whether the two given paths within the [Root]'s directory
+// tree refer to the same inode (such as two hardlinks to the same file, or a
+// path and a symlink to it), by comparing their device and inode numbers. All
+// symlinks (including trailing symlinks) are followed within the rootfs. As
+// with [Root.Exists], if either path does not exist (false, nil) is returned.
+//
+// This is effectively equivalent to [os.SameFile] with the result of
+// [Root.Stat] on each path.
+//
+// [os.SameFile]: https://pkg.go.dev/os#SameFile
+func (r *Root) SameFile(path1, path2 string) (bool, error) {
+	info1, err := r.Stat(path1)
+	if err != nil {
+		if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ENOTDIR) {
+			return false, nil
+		}
+		return false, err
+	}
+	info2, err := r.Stat(path2)
+	if err != nil {
+		if errors.Is(err, unix.ENOENT) || errors.Is(err, unix.ENOTDIR) {
+			return false, nil
+		}
+		return false, err
+	}
+	return os.SameFile(info1, info2), nil
+}
+
+// Statfs returns information about the filesystem containing the file at the
+// given path within the [Root]'s directory tree. All symlinks (including
+// trailing symlinks) are followed within the rootfs.
+//
+// Because the statfs(2) information is fetched from a [Handle] to the
+// resolved path (using fstatfs(2)), the result is guaranteed to describe the
+// filesystem of the path as it was resolved within the rootfs. The Type field
+// can be compared against the *_MAGIC constants in [unix] to determine the
+// filesystem type.
+//
+// [unix]: https://pkg.go.dev/golang.org/x/sys/unix
+func (r *Root) Statfs(path string) (*unix.Statfs_t, error) {
+	handle, err := r.Resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+
+	return withFileFd(handle.inner, func(fd uintptr) (*unix.Statfs_t, error) {
+		var stat unix.Statfs_t
+		if err := unix.Fstatfs(int(fd), &stat); err != nil {
+			return nil, fmt.Errorf("fstatfs: %w", err)
+		}
+		return &stat, nil
+	})
+}
+
+// AccessMode is a bitmask of the permissions to check with [Root.Access].
+type AccessMode uint32
+
+// Permissions that can be checked with [Root.Access]. These correspond to the
+// F_OK, R_OK, W_OK, and X_OK arguments to access(2). Apart from AccessExists,
+// they can be combined with a bitwise OR.
+const (
+	// AccessExists only checks that the path exists.
+	AccessExists AccessMode = unix.F_OK
+	// AccessRead checks that the path can be read.
+	AccessRead AccessMode = unix.R_OK
+	// AccessWrite checks that the path can be written to.
+	AccessWrite AccessMode = unix.W_OK
+	// AccessExecute checks that the path can be executed (or searched, in
+	// the case of directories).
+	AccessExecute AccessMode = unix.X_OK
+)
+
+// AccessEffectiveIDs can be passed as a flag to [Root.Access] to perform the
+// permission check using the effective user and group IDs of the process
+// (AT_EACCESS) rather than the real IDs.
+const AccessEffectiveIDs = unix.AT_EACCESS
+
+// Access checks whether the calling process can access the file at the given
+// path within the [Root]'s directory tree with the permissions described by
+// mode. All symlinks (including trailing symlinks) are followed within the
+// rootfs. If access is permitted, nil is returned. Otherwise an error wrapping
+// the reason is returned (such as EACCES, or ENOENT if the path does not
+// exist).
+//
+// By default (as with access(2)) the check uses the real user and group IDs
+// of the process. If flags contains [AccessEffectiveIDs], the effective IDs
+// are used instead.
+//
+// As with access(2), the result is only advisory -- the permissions of the
+// file may change before you try to use it, so you should still handle errors
+// from the operation itself.
+func (r *Root) Access(path string, mode AccessMode, flags int) error {
+	handle, err := r.Resolve(path)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	_, err = withFileFd(handle.inner, func(fd uintptr) (struct{}, error) {
+		return withProcfsFd(fd, func(procFd uintptr, name string) (struct{}, error) {
+			if err := unix.Faccessat(int(procFd), name, uint32(mode), flags); err != nil {
+				return struct{}{}, fmt.Errorf("faccessat: %w", err)
+			}
+			return struct{}{}, nil
+		})
+	})
+	return err
+}
+
+// Open is effectively shorthand for [Root.Resolve] followed by [Handle.Open],
+// but can be slightly more efficient (it reduces CGo overhead and the number
+// of syscalls used when using the openat2-based resolver) and is arguably more
+// ergonomic to use.
+//
+// This is effectively equivalent to [os.Open].
+//
+// [os.Open]: https://pkg.go.dev/os#Open
+func (r *Root) Open(path string) (*os.File, error) {
+	return r.OpenFile(path, os.O_RDONLY, 0)
+}
+
+// OpenFile is effectively shorthand for [Root.Resolve] followed by
+// [Handle.Reopen], but can be slightly more efficient (it reduces CGo
+// overhead and the number of syscalls used when using the openat2-based
+// resolver) and is arguably more ergonomic to use.
+//
+// If flags contains os.O_CREATE, OpenFile is equivalent to [Root.Create] and
+// the file is created (with the provided mode) if it does not already exist.
+// os.O_EXCL, os.O_TRUNC, and os.O_APPEND have their usual meanings. The mode
+// is ignored if os.O_CREATE is not set.
+//
+// However, if flags contains os.O_NOFOLLOW and the path is a symlink, then
+// OpenFile's behaviour will match that of openat2. In most cases an error will
+// be returned, but if os.O_PATH is provided along with os.O_NOFOLLOW then a
+// file equivalent to [Root.ResolveNoFollow] will be returned instead.
+//
+// This is effectively equivalent to [os.OpenFile].
+//
+// [os.OpenFile]: https://pkg.go.dev/os#OpenFile
+func (r *Root) OpenFile(path string, flags int, mode os.FileMode) (*os.File, error) {
+	if flags&os.O_CREATE != 0 {
+		return r.Create(path, flags, mode)
+	}
+	file, err := withRootFd(r, func(rootFd uintptr) (*os.File, error) {
+		fd, err := pathrsInRootOpen(rootFd, path, flags)
+		if err != nil {
+			return nil, err
+		}
+		return mkFile(fd), nil
+	})
+	audit("open", path, file, err)
+	return file, err
+}
+
+// Create creates a file within the [Root]'s directory tree at the given path,
+// and returns a handle to the file. The provided mode is used for the new file
+// (the process's umask applies).
+//
+// If the file already exists it is opened (and truncated if flags contains
+// os.O_TRUNC), unless flags contains os.O_EXCL in which case an error wrapping
+// EEXIST (so [errors.Is] with [fs.ErrExist] is true) is returned. If the path
+// is an existing directory, an error wrapping EISDIR is returned. A symlink
+// at the final component of the path is never followed, so if an attacker
+// swaps the path with a symlink you will get an error rather than creating a
+// file somewhere else.
+//
+// This is effectively equivalent to [os.OpenFile] with os.O_CREATE.
+//
+// [errors.Is]: https://pkg.go.dev/errors#Is
+// [fs.ErrExist]: https://pkg.go.dev/io/fs#ErrExist
+// [os.OpenFile]: https://pkg.go.dev/os#OpenFile
+func (r *Root) Create(path string, flags int, mode os.FileMode) (*os.File, error) {
+	unixMode, err := toUnixMode(mode)
+	if err != nil {
+		return nil, err
+	}
+	file, err := withRootFd(r, func(rootFd uintptr) (*os.File, error) {
+		handleFd, err := pathrsInRootCreat(rootFd, path, flags, unixMode)
+		if err != nil {
+			return nil, err
+		}
+		return mkFile(handleFd), nil
+	})
+	audit("creat", path, file, err)
+	return file, err
+}
+
+// CreateMode is identical to [Root.Create], except that if applyUmask is false
+// the mode of the file is set to exactly the requested mode (including any
+// setuid, setgid, and sticky bits) regardless of the process's umask. This is
+// useful when restoring archives, as changing the umask is process-wide and
+// thus racy in multi-threaded programs.
+//
+// The file is first created with the umask applied (so it is never more
+// permissive than requested) and the mode is then changed with fchmod(2), so
+// there is no window where the file has broader permissions than requested.
+// Note that if the file already existed (and flags does not contain
+// os.O_EXCL), its mode is also changed to the requested mode. If changing the
+// mode fails, the file is closed and an error is returned (but the file is not
+// removed).
+func (r *Root) CreateMode(path string, flags int, mode os.FileMode, applyUmask bool) (*os.File, error) {
+	file, err := r.Create(path, flags, mode)
+	if err != nil || applyUmask {
+		return file, err
+	}
+
+	unixMode, err := toUnixMode(mode &^ os.ModeType)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	unixMode &^= unix.S_IFMT
+
+	if _, err := withFileFd(file, func(fd uintptr) (struct{}, error) {
+		if err := unix.Fchmod(int(fd), unixMode); err != nil {
+			return struct{}{}, fmt.Errorf("fchmod %s: %w", path, err)
+		}
+		return struct{}{}, nil
+	}); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// createExclusiveAttempts is the number of times CreateExclusive will retry
+// if the path is concurrently created and removed by someone else.
+const createExclusiveAttempts = 16
+
+// CreateExclusive creates a new file at the given path within the [Root]'s
+// directory tree (with O_CREAT|O_EXCL), and returns a [Handle] to it along
+// with whether the file was created by this call. If the path already exists,
+// a [Handle] to the existing inode is returned instead (a trailing symlink is
+// not followed, as with [Root.ResolveNoFollow]) along with false. The
+// provided mode is used for the new file (the process's umask applies).
+//
+// This is the equivalent of the classic exclusive-create lock file idiom.
+// Exactly one concurrent caller will get true for a given file, and the
+// returned [Handle] always refers to the inode that was created (or found),
+// even if the path is concurrently replaced afterwards. If the existing path
+// is removed between the failed creation and the lookup, the creation is
+// retried. Any other error is returned as-is.
+func (r *Root) CreateExclusive(path string, mode os.FileMode) (*Handle, bool, error) {
+	for i := 0; ; i++ {
+		file, err := r.Create(path, os.O_RDONLY|os.O_EXCL, mode)
+		if err == nil {
+			defer file.Close()
+			handle, err := withFileFd(file, func(fd uintptr) (*Handle, error) {
+				// Get an O_PATH handle to the inode we just created.
+				handleFd, err := pathrsReopen(fd, unix.O_PATH)
+				if err != nil {
+					return nil, err
+				}
+				return newHandle(mkFile(handleFd)), nil
+			})
+			return handle, err == nil, err
+		}
+		if !errors.Is(err, unix.EEXIST) {
+			return nil, false, err
+		}
+
+		handle, err := r.ResolveNoFollow(path)
+		switch {
+		case err == nil:
+			return handle, false, nil
+		case errors.Is(err, unix.ENOENT) && i < createExclusiveAttempts:
+			continue
+		default:
+			return nil, false, err
+		}
+	}
+}
+
+// CreateTemp creates an unnamed temporary file (with O_TMPFILE) inside the
+// directory at the given path within the [Root]'s directory tree, and returns
+// a [Handle] to it. All symlinks (including trailing symlinks) in dir are
+// followed within the rootfs. The provided mode is used for the new file (the
+// process's umask applies).
+//
+// The file can be written to by re-opening the [Handle] with
+// [Handle.Reopen], and can be given a name within the [Root] with
+// [Root.LinkHandle]. If the file is never linked, it is freed when the last
+// reference to it is closed. This allows for crash-safe atomic file creation.
+//
+// If the filesystem (or kernel) does not support O_TMPFILE, an error wrapping
+// [ErrUnsupported] is returned, in which case callers should fall back to
+// creating a named temporary file.
+func (r *Root) CreateTemp(dir string, mode os.FileMode) (*Handle, error) {
+	unixMode, err := toUnixMode(mode &^ os.ModeType)
+	if err != nil {
+		return nil, err
+	}
+	unixMode &^= unix.S_IFMT
+
+	dirHandle, err := r.Resolve(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer dirHandle.Close()
+
+	return withFileFd(dirHandle.inner, func(dirFd uintptr) (*Handle, error) {
+		fd, err := unix.Openat(int(dirFd), ".", unix.O_TMPFILE|unix.O_RDWR|unix.O_CLOEXEC, unixMode)
+		switch {
+		case err == nil:
+			return newHandle(mkFile(uintptr(fd))), nil
+		// Kernels without O_TMPFILE support treat it as O_DIRECTORY, which
+		// gives EISDIR when combined with O_RDWR.
+		case errors.Is(err, unix.EOPNOTSUPP), errors.Is(err, unix.EISDIR):
+			return nil, fmt.Errorf("openat(O_TMPFILE) in %s: %w: %w", dir, ErrUnsupported, err)
+		default:
+			return nil, fmt.Errorf("openat(O_TMPFILE) in %s: %w", dir, err)
+		}
+	})
+}
+
+// LinkHandle gives the file referenced by the [Handle] a name at the given
+// path within the [Root]'s directory tree, such as to "materialise" a
+// temporary file created with [Root.CreateTemp]. The parent directory of path
+// is resolved with [Root.ResolveParent], and if path already exists an error
+// wrapping EEXIST is returned.
+//
+// The link is created through /proc/thread-self/fd (with AT_SYMLINK_FOLLOW),
+// so unlike linkat(2) with AT_EMPTY_PATH this does not require
+// CAP_DAC_READ_SEARCH.
+func (r *Root) LinkHandle(h *Handle, path string) error {
+	parent, name, err := r.ResolveParent(path)
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+
+	_, err = withFileFd(parent.inner, func(parentFd uintptr) (struct{}, error) {
+		return withFileFd(h.inner, func(fd uintptr) (struct{}, error) {
+			return withProcfsFd(fd, func(procFd uintptr, fdName string) (struct{}, error) {
+				if err := unix.Linkat(int(procFd), fdName, int(parentFd), name, unix.AT_SYMLINK_FOLLOW); err != nil {
+					return struct{}{}, fmt.Errorf("linkat(/proc/thread-self/fd/%s, %s): %w", fdName, path, err)
+				}
+				return struct{}{}, nil
+			})
+		})
+	})
+	return err
+}
+
+// Truncate changes the size of the file at the given path within the [Root]'s
+// directory tree. All symlinks (including trailing symlinks) are followed
+// within the rootfs. See [Handle.Truncate] for more details.
+//
+// This is effectively equivalent to [os.Truncate].
+//
+// [os.Truncate]: https://pkg.go.dev/os#Truncate
+func (r *Root) Truncate(path string, size int64) error {
+	if size < 0 {
+		return &Error{
+			Errno:       unix.EINVAL,
+			Op:          "truncate",
+			Path:        path,
+			Description: "cannot truncate file to negative size",
+		}
+	}
+
+	handle, err := r.Resolve(path)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	return handle.Truncate(size)
+}
+
+// Flags for [Root.Rename]. These correspond to the RENAME_* flags for the
+// renameat2(2) system call, and can be combined with a bitwise OR (subject to
+// the restrictions described below).
+const (
+	// RenameNoReplace causes the rename to fail with EEXIST if the
+	// destination already exists, rather than replacing it. It cannot be
+	// combined with RenameExchange.
+	RenameNoReplace uint = unix.RENAME_NOREPLACE
+	// RenameExchange atomically swaps the source and destination, both of
+	// which must already exist (they may be of different types). It cannot
+	// be combined with RenameNoReplace or RenameWhiteout.
+	RenameExchange uint = unix.RENAME_EXCHANGE
+	// RenameWhiteout creates a whiteout object at the source path after the
+	// rename. This is only useful for overlay and union filesystems, and
+	// requires CAP_MKNOD. It cannot be combined with RenameExchange.
+	RenameWhiteout uint = unix.RENAME_WHITEOUT
+)
+
+// validateRenameFlags returns an error if the given flags are not a valid
+// combination of RENAME_* flags for renaming src.
+func validateRenameFlags(src string, flags uint) error {
+	var desc string
+	switch {
+	case flags&^(RenameNoReplace|RenameExchange|RenameWhiteout) != 0:
+		desc = fmt.Sprintf("unknown rename flags %#x", flags)
+	case flags&RenameExchange != 0 && flags&RenameNoReplace != 0:
+		desc = "RenameExchange cannot be combined with RenameNoReplace"
+	case flags&RenameExchange != 0 && flags&RenameWhiteout != 0:
+		desc = "RenameExchange cannot be combined with RenameWhiteout"
+	default:
+		return nil
+	}
+	return &Error{
+		Errno:       unix.EINVAL,
+		Op:          "rename",
+		Path:        src,
+		Description: desc,
+	}
+}
+
+// Rename two paths within a [Root]'s directory tree. The flags argument is
+// identical to the RENAME_* flags to the renameat2(2) system call, and the
+// [RenameNoReplace], [RenameExchange], and [RenameWhiteout] constants are
+// provided for convenience. Invalid combinations of flags (such as
+// RenameExchange|RenameNoReplace) are rejected with EINVAL before any
+// operation is attempted.
+func (r *Root) Rename(src, dst string, flags uint) error {
+	if err := validateRenameFlags(src, flags); err != nil {
+		return err
+	}
+	_, err := withRootFd(r, func(rootFd uintptr) (struct{}, error) {
+		err := pathrsInRootRename(rootFd, src, dst, flags)
+		return struct{}{}, err
+	})
+	return err
+}
+
+// RenameResolve is like [Root.Rename], except that dst is resolved after the
+// rename is complete and a [Handle] to it is returned. For RenameExchange,
+// this is a [Handle] to the inode that was previously at src (which is now at
+// dst). The trailing component of dst is not followed (as with
+// [Root.ResolveNoFollow]), since rename(2) moves symlinks themselves rather
+// than their targets.
+//
+// Note that the rename and the resolution are two separate operations, so the
+// returned [Handle] reflects the state of dst after the rename. If dst is
+// concurrently modified (such as being replaced by another process), the
+// [Handle] may not reference the inode that was renamed.
+func (r *Root) RenameResolve(src, dst string, flags uint) (*Handle, error) {
+	if err := r.Rename(src, dst, flags); err != nil {
+		return nil, err
+	}
+	return r.ResolveNoFollow(dst)
+}
+
+// checkDirHandle returns an error if the [Handle] does not reference a
+// directory.
+func checkDirHandle(op string, h *Handle) error {
+	info, err := h.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return &Error{
+			Errno:       unix.ENOTDIR,
+			Op:          op,
+			Path:        h.Name(),
+			Description: "handle does not reference a directory",
+		}
+	}
+	return nil
+}
+
+// checkSingleComponent returns an error if name is not a single path
+// component that can be safely used relative to a directory [Handle].
+func checkSingleComponent(op, name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') {
+		return &Error{
+			Errno:       unix.EINVAL,
+			Op:          op,
+			Path:        name,
+			Description: "name must be a single path component",
+		}
+	}
+	return nil
+}
+
+// RenameAt renames oldName in the directory referenced by oldDir to newName
+// in the directory referenced by newDir, using renameat2(2). This allows for
+// many renames within (or between) directories that have already been
+// resolved (such as with [Root.ResolveParent]) without needing to resolve the
+// paths again each time. The flags argument is the same as for
+// [Root.Rename].
+//
+// Both oldName and newName must be a single path component (they must not
+// contain "/" and must not be "." or ".."), and both [Handle]s must reference
+// directories. Otherwise an error is returned.
+func RenameAt(oldDir *Handle, oldName string, newDir *Handle, newName string, flags uint) error {
+	for _, name := range []string{oldName, newName} {
+		if err := checkSingleComponent("renameat", name); err != nil {
+			return err
+		}
+	}
+	for _, dir := range []*Handle{oldDir, newDir} {
+		if err := checkDirHandle("renameat", dir); err != nil {
+			return err
+		}
+	}
+	if err := validateRenameFlags(oldName, flags); err != nil {
+		return err
+	}
+
+	_, err := withFileFd(oldDir.inner, func(oldFd uintptr) (struct{}, error) {
+		return withFileFd(newDir.inner, func(newFd uintptr) (struct{}, error) {
+			if err := unix.Renameat2(int(oldFd), oldName, int(newFd), newName, flags); err != nil {
+				return struct{}{}, fmt.Errorf("renameat2 %s to %s: %w", oldName, newName, err)
+			}
+			return struct{}{}, nil
+		})
+	})
+	return err
+}
+
+// MoveInto moves src into the directory destDir (both within the [Root]'s
+// directory tree), keeping the final component of src as its name. For
+// instance, MoveInto("a/b", "c", 0) renames "a/b" to "c/b". The flags argument
+// is the same as for [Root.Rename] (so [RenameNoReplace] can be used to avoid
+// overwriting an existing entry in destDir).
+//
+// Both destDir and the parent directory of src are resolved to handles before
+// the rename is done (using [RenameAt]), so swapping destDir for a symlink
+// after it has been resolved has no effect. If destDir is not a directory, an
+// error wrapping ENOTDIR is returned.
+func (r *Root) MoveInto(src, destDir string, flags uint) error {
+	srcDir, name, err := r.ResolveParent(src)
+	if err != nil {
+		return err
+	}
+	defer srcDir.Close()
+
+	dstDir, err := r.Resolve(destDir)
+	if err != nil {
+		return err
+	}
+	defer dstDir.Close()
+
+	return RenameAt(srcDir, name, dstDir, name, flags)
+}
+
+// RemoveDir removes the named empty directory within a [Root]'s directory
+// tree.
+func (r *Root) RemoveDir(path string) error {
+	_, err := withRootFd(r, func(rootFd uintptr) (struct{}, error) {
+		err := pathrsInRootRmdir(rootFd, path)
+		return struct{}{}, err
+	})
+	return err
+}
+
+// RemoveFile removes the named file within a [Root]'s directory tree.
+func (r *Root) RemoveFile(path string) error {
+	_, err := withRootFd(r, func(rootFd uintptr) (struct{}, error) {
+		err := pathrsInRootUnlink(rootFd, path)
+		return struct{}{}, err
+	})
+	return err
+}
+
+// Remove removes the named file or (empty) directory within a [Root]'s
+// directory tree.
+//
+// This is effectively equivalent to [os.Remove].
+//
+// [os.Remove]: https://pkg.go.dev/os#Remove
+func (r *Root) Remove(path string) error {
+	// In order to match os.Remove's implementation we need to also do both
+	// syscalls unconditionally and adjust the error based on whether
+	// pathrs_inroot_rmdir() returned ENOTDIR.
+	unlinkErr := r.RemoveFile(path)
+	if unlinkErr == nil {
+		return nil
+	}
+	rmdirErr := r.RemoveDir(path)
+	if rmdirErr == nil {
+		return nil
+	}
+	// Both failed, adjust the error in the same way that os.Remove does.
+	err := rmdirErr
+	if errors.Is(err, syscall.ENOTDIR) {
+		err = unlinkErr
+	}
+	return err
+}
+
+// RemoveAll recursively deletes a path and all of its children.
+//
+// This is effectively equivalent to [os.RemoveAll].
+//
+// [os.RemoveAll]: https://pkg.go.dev/os#RemoveAll
+func (r *Root) RemoveAll(path string) error {
+	_, err := withRootFd(r, func(rootFd uintptr) (struct{}, error) {
+		err := pathrsInRootRemoveAll(rootFd, path)
+		return struct{}{}, err
+	})
+	return err
+}
+
+// Mkdir creates a directory within a [Root]'s directory tree. The provided
+// mode is used for the new directory (the process's umask applies).
+//
+// If the path already exists (whether or not it is a directory), an
+// [ExistError] wrapping EEXIST is returned, which can be used to tell whether
+// the existing inode is a directory. If a parent component of the path is not
+// a directory, an error wrapping ENOTDIR is returned.
+//
+// This is effectively equivalent to [os.Mkdir].
+//
+// [os.Mkdir]: https://pkg.go.dev/os#Mkdir
+func (r *Root) Mkdir(path string, mode os.FileMode) error {
+	unixMode, err := toUnixMode(mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = withRootFd(r, func(rootFd uintptr) (struct{}, error) {
+		err := pathrsInRootMkdir(rootFd, path, unixMode)
+		return struct{}{}, err
+	})
+	return r.mkdirError(path, err)
+}
+
+// mkdirError converts EEXIST errors from mkdir into an [ExistError].
+func (r *Root) mkdirError(path string, err error) error {
+	var perr *Error
+	if errors.As(err, &perr) && perr.Errno == unix.EEXIST {
+		info, statErr := r.Lstat(path)
+		return &ExistError{Err: perr, IsDir: statErr == nil && info.IsDir()}
+	}
+	return err
+}
+
+// MkdirAll creates a directory (and any parent path components if they don't
+// exist) within a [Root]'s directory tree. The provided mode is used for any
+// directories created by this function (the process's umask applies).
+//
+// Existing directories in the path are not an error, but an existing
+// non-directory component will result in an ENOTDIR error. If you need a
+// handle to the final directory, use [Root.MkdirAllHandle].
+//
+// This is effectively equivalent to [os.MkdirAll].
+//
+// [os.MkdirAll]: https://pkg.go.dev/os#MkdirAll
+func (r *Root) MkdirAll(path string, mode os.FileMode) error {
+	handle, err := r.MkdirAllHandle(path, mode)
+	if err != nil {
+		return err
+	}
+	return handle.Close()
+}
+
+// MkdirAllHandle is identical to [Root.MkdirAll], except that it also returns
+// a [Handle] to the final directory in the path. This handle is safe to use
+// even if an attacker tried to swap one of the path components during the
+// operation.
+func (r *Root) MkdirAllHandle(path string, mode os.FileMode) (*Handle, error) {
+	unixMode, err := toUnixMode(mode)
+	if err != nil {
+		return nil, err
+	}
+
+	handle, err := withRootFd(r, func(rootFd uintptr) (*Handle, error) {
+		handleFd, err := pathrsInRootMkdirAll(rootFd, path, unixMode)
+		if err != nil {
+			return nil, err
+		}
+		return newHandle(mkFile(handleFd)), nil
+	})
+	auditHandle("mkdir_all", path, handle, err)
+	return handle, err
+}
+
+// EnsureDir returns a [Handle] to the directory at the given path within the
+// [Root]'s directory tree, creating it (and any missing parent directories,
+// as with [Root.MkdirAllHandle]) if it does not exist. All symlinks (including
+// trailing symlinks) are followed within the rootfs.
+//
+// EnsureDir is idempotent, and concurrent callers creating the same directory
+// all succeed. If the path exists but is not a directory, an [ExistError]
+// (with IsDir set to false) is returned.
+func (r *Root) EnsureDir(path string, mode os.FileMode) (*Handle, error) {
+	handle, err := r.resolveExistingDir(path)
+	if !errors.Is(err, unix.ENOENT) {
+		return handle, err
+	}
+
+	handle, err = r.MkdirAllHandle(path, mode)
+	if errors.Is(err, unix.EEXIST) {
+		// A concurrent caller created the path between our lookup and
+		// MkdirAllHandle.
+		return r.resolveExistingDir(path)
+	}
+	return handle, err
+}
+
+// resolveExistingDir resolves path and checks that it is a directory,
+// returning an [ExistError] if it is not.
+func (r *Root) resolveExistingDir(path string) (*Handle, error) {
+	handle, err := r.Resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := handle.Stat()
+	if err != nil {
+		_ = handle.Close()
+		return nil, fmt.Errorf("stat directory: %w", err)
+	}
+	if !info.IsDir() {
+		_ = handle.Close()
+		return nil, &ExistError{
+			Err: &Error{
+				Errno:       unix.EEXIST,
+				Op:          "ensure_dir",
+				Path:        path,
+				Description: "path exists but is not a directory",
+			},
+		}
+	}
+	return handle, nil
+}
+
+// Mkdev returns a device number (for use with [Root.Mknod]) from the given
+// major and minor numbers, using the same encoding as glibc's makedev(3).
+func Mkdev(major, minor uint32) uint64 {
+	return unix.Mkdev(major, minor)
+}
+
+// Major returns the major component of a device number, such as one created
+// with [Mkdev].
+func Major(dev uint64) uint32 {
+	return unix.Major(dev)
+}
+
+// Minor returns the minor component of a device number, such as one created
+// with [Mkdev].
+func Minor(dev uint64) uint32 {
+	return unix.Minor(dev)
+}
+
+// Mknod creates a new device inode of the given type within a [Root]'s
+// directory tree. The provided mode is used for the new directory (the
+// process's umask applies). The device number can be constructed with
+// [Mkdev].
+//
+// If the path already exists, the returned error wraps EEXIST (and thus
+// matches [fs.ErrExist]).
+//
+// This is effectively equivalent to [unix.Mknod].
+//
+// [fs.ErrExist]: https://pkg.go.dev/io/fs#ErrExist
+// [unix.Mknod]: https://pkg.go.dev/golang.org/x/sys/unix#Mknod
+func (r *Root) Mknod(path string, mode os.FileMode, dev uint64) error {
+	unixMode, err := toUnixMode(mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = withRootFd(r, func(rootFd uintptr) (struct{}, error) {
+		err := pathrsInRootMknod(rootFd, path, unixMode, dev)
+		return struct{}{}, err
+	})
+	return err
+}
+
+// Mkfifo creates a named pipe (FIFO) within a [Root]'s directory tree. The
+// provided mode is used for the new FIFO (the process's umask applies), and
+// must not contain any file type bits other than [os.ModeNamedPipe] (otherwise
+// an error wrapping EINVAL is returned).
+//
+// This is effectively equivalent to [unix.Mkfifo].
+//
+// [os.ModeNamedPipe]: https://pkg.go.dev/os#ModeNamedPipe
+// [unix.Mkfifo]: https://pkg.go.dev/golang.org/x/sys/unix#Mkfifo
+func (r *Root) Mkfifo(path string, mode os.FileMode) error {
+	if fileType := mode & os.ModeType; fileType != 0 && fileType != os.ModeNamedPipe {
+		return &Error{
+			Errno:       unix.EINVAL,
+			Op:          "mkfifo",
+			Path:        path,
+			Description: fmt.Sprintf("mode %v has a file type other than a named pipe", mode),
+		}
+	}
+	return r.Mknod(path, mode|os.ModeNamedPipe, 0)
+}
+
+// Symlink creates a symlink within a [Root]'s directory tree. The symlink is
+// created at path and is a link to target.
+//
+// If the path already exists, the returned error wraps EEXIST (and thus
+// matches [fs.ErrExist]).
+//
+// This is effectively equivalent to [os.Symlink].
+//
+// [fs.ErrExist]: https://pkg.go.dev/io/fs#ErrExist
 // [os.Symlink]: https://pkg.go.dev/os#Symlink
 func (r *Root) Symlink(path, target string) error {
-	_, err := withFileFd(r.inner, func(rootFd uintptr) (struct{}, error) {
+	_, err := withRootFd(r, func(rootFd uintptr) (struct{}, error) {
 		err := pathrsInRootSymlink(rootFd, path, target)
 		return struct{}{}, err
 	})
 	return err
 }
 
+// symlinkTempAttempts is the number of temporary names SymlinkForce will try
+// before giving up.
+const symlinkTempAttempts = 16
+
+// SymlinkForce is like [Root.Symlink], except that if path already exists it
+// is atomically replaced with the new symlink (unless it is a directory, in
+// which case an error is returned). This is useful for atomically re-pointing
+// a symlink, such as a "current" symlink to a versioned directory.
+//
+// The symlink is first created with a temporary name in the parent directory
+// of path, and is then renamed over path. Both operations are done relative to
+// a [Handle] to the parent directory (from [Root.ResolveParent]), so they are
+// not affected by an attacker swapping the parent directory for a symlink. If
+// the rename fails, the temporary symlink is removed.
+func (r *Root) SymlinkForce(path, target string) error {
+	parent, name, err := r.ResolveParent(path)
+	if err != nil {
+		return err
+	}
+	defer parent.Close()
+
+	_, err = withFileFd(parent.inner, func(parentFd uintptr) (struct{}, error) {
+		var tmpName string
+		for i := 0; ; i++ {
+			var randBytes [8]byte
+			if _, err := rand.Read(randBytes[:]); err != nil {
+				return struct{}{}, fmt.Errorf("generate temporary symlink name: %w", err)
+			}
+			tmpName = "." + name + ".tmp-" + hex.EncodeToString(randBytes[:])
+			err := unix.Symlinkat(target, int(parentFd), tmpName)
+			if err == nil {
+				break
+			}
+			if !errors.Is(err, unix.EEXIST) || i >= symlinkTempAttempts {
+				return struct{}{}, fmt.Errorf("symlinkat temporary symlink for %s: %w", path, err)
+			}
+		}
+
+		if err := unix.Renameat(int(parentFd), tmpName, int(parentFd), name); err != nil {
+			_ = unix.Unlinkat(int(parentFd), tmpName, 0)
+			return struct{}{}, fmt.Errorf("renameat temporary symlink over %s: %w", path, err)
+		}
+		return struct{}{}, nil
+	})
+	return err
+}
+
 // Hardlink creates a hardlink within a [Root]'s directory tree. The hardlink
 // is created at path and is a link to target. Both paths are within the
 // [Root]'s directory tree (you cannot hardlink to a different [Root] or the
 // host).
 //
+// If the path already exists, the returned error wraps EEXIST (and thus
+// matches [fs.ErrExist]).
+//
 // This is effectively equivalent to [os.Link].
 //
+// [fs.ErrExist]: https://pkg.go.dev/io/fs#ErrExist
 // [os.Link]: https://pkg.go.dev/os#Link
 func (r *Root) Hardlink(path, target string) error {
-	_, err := withFileFd(r.inner, func(rootFd uintptr) (struct{}, error) {
+	_, err := withRootFd(r, func(rootFd uintptr) (struct{}, error) {
 		err := pathrsInRootHardlink(rootFd, path, target)
 		return struct{}{}, err
 	})
 	return err
 }
 
+// HardlinkFlags is like [Root.Hardlink], except that linkat(2) flags can be
+// provided to modify its behaviour. The only supported flag is
+// unix.AT_SYMLINK_FOLLOW, which causes the hardlink to be created to the inode
+// that a trailing symlink in target points to, rather than to the symlink
+// itself (which is what [Root.Hardlink] does). The symlink is resolved within
+// the [Root]'s directory tree, as with [Root.Resolve]. Any other flags result
+// in an error wrapping EINVAL.
+//
+// Note that following symlinks in an untrusted directory tree means that an
+// attacker controls which inode the hardlink will reference (within the
+// [Root]). This cannot be used to escape the [Root], but callers that make
+// decisions based on target (such as checking its ownership or mode first)
+// must re-check the linked file instead, as the symlink could be swapped
+// between the check and the link. Unless you need to follow symlinks, prefer
+// [Root.Hardlink].
+func (r *Root) HardlinkFlags(path, target string, flags int) error {
+	switch flags {
+	case 0:
+		return r.Hardlink(path, target)
+	case unix.AT_SYMLINK_FOLLOW:
+		handle, err := r.Resolve(target)
+		if err != nil {
+			return err
+		}
+		defer handle.Close()
+		return r.LinkHandle(handle, path)
+	default:
+		return &Error{
+			Errno:       unix.EINVAL,
+			Op:          "hardlink",
+			Path:        path,
+			Description: fmt.Sprintf("unsupported hardlink flags %#x", flags),
+		}
+	}
+}
+
+// ReadFile reads the contents of the file at the given path within the
+// [Root]'s directory tree. All symlinks (including trailing symlinks) are
+// followed within the rootfs.
+//
+// Unlike [os.ReadFile], the buffer is not pre-allocated based on the size of
+// the file (which could be misleading for files such as those in procfs, or
+// if the file is being modified concurrently), and is instead grown as the
+// file is read.
+//
+// [os.ReadFile]: https://pkg.go.dev/os#ReadFile
+func (r *Root) ReadFile(path string) ([]byte, error) {
+	file, err := r.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	return data, nil
+}
+
+// ReadFileLimit is like [Root.ReadFile], except that at most limit bytes
+// are read. If the file contains more than limit bytes, an error wrapping
+// [ErrTooLarge] is returned. This is useful when reading untrusted files, as
+// the size reported by stat(2) is not used (it may be wrong, or the file
+// may grow while it is being read) -- instead, limit+1 bytes are read to check
+// whether the limit is exceeded.
+func (r *Root) ReadFileLimit(path string, limit int64) ([]byte, error) {
+	if limit < 0 {
+		return nil, &Error{
+			Errno:       unix.EINVAL,
+			Op:          "read_file_limit",
+			Path:        path,
+			Description: fmt.Sprintf("negative size limit %d", limit),
+		}
+	}
+
+	file, err := r.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Read one more byte than the limit to detect oversized files (taking
+	// care not to overflow).
+	readLimit := limit
+	if readLimit < math.MaxInt64 {
+		readLimit++
+	}
+	data, err := io.ReadAll(io.LimitReader(file, readLimit))
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("read %s: %w (limit is %d bytes)", path, ErrTooLarge, limit)
+	}
+	return data, nil
+}
+
+// Mmap maps the file at the given path within the [Root]'s directory tree
+// into memory (read-only), and returns the mapped bytes along with a function
+// to unmap them. All symlinks (including trailing symlinks) are followed
+// within the rootfs. The file is closed before Mmap returns, but the mapping
+// remains valid until the unmap function is called (calling it more than
+// once returns [ErrClosed]). The mapped bytes must not be used after calling
+// the unmap function.
+//
+// Empty files result in an empty (non-nil) slice, without creating a
+// mapping. Note that if the file is truncated while it is mapped, accessing
+// the truncated region of the mapping will crash the program with SIGBUS, so
+// this should only be used with files that will not be modified.
+func (r *Root) Mmap(path string) ([]byte, func() error, error) {
+	file, err := r.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, nil, fmt.Errorf("stat %s: %w", path, err)
+	}
+	size := info.Size()
+	if size > math.MaxInt {
+		return nil, nil, fmt.Errorf("mmap %s: file too large (%d bytes): %w", path, size, unix.EFBIG)
+	}
+
+	// mmap(2) does not allow zero-length mappings.
+	data := []byte{}
+	if size > 0 {
+		data, err = withFileFd(file, func(fd uintptr) ([]byte, error) {
+			return unix.Mmap(int(fd), 0, int(size), unix.PROT_READ, unix.MAP_SHARED)
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("mmap %s: %w", path, err)
+		}
+	}
+
+	var unmapped atomic.Bool
+	unmap := func() error {
+		if !unmapped.CompareAndSwap(false, true) {
+			return ErrClosed
+		}
+		if len(data) == 0 {
+			return nil
+		}
+		if err := unix.Munmap(data); err != nil {
+			return fmt.Errorf("munmap %s: %w", path, err)
+		}
+		return nil
+	}
+	return data, unmap, nil
+}
+
+func (r *Root) writeFile(path string, data []byte, mode os.FileMode, sync bool) (retErr error) {
+	file, err := r.Create(path, os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := file.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	if err := writeAll(file, data); err != nil {
+		return err
+	}
+	if sync {
+		return file.Sync()
+	}
+	return nil
+}
+
+// WriteFile writes data to the file at the given path within the [Root]'s
+// directory tree, creating it with the given mode (the process's umask
+// applies) if it does not exist and truncating it otherwise. As with
+// [Root.Create], a trailing symlink is never followed.
+//
+// This is effectively equivalent to [os.WriteFile].
+//
+// [os.WriteFile]: https://pkg.go.dev/os#WriteFile
+func (r *Root) WriteFile(path string, data []byte, mode os.FileMode) error {
+	return r.writeFile(path, data, mode, false)
+}
+
+// WriteFileSync is identical to [Root.WriteFile], except that the file is
+// synced to disk with fsync(2) before it is closed.
+func (r *Root) WriteFileSync(path string, data []byte, mode os.FileMode) error {
+	return r.writeFile(path, data, mode, true)
+}
+
+// CopyFile copies the contents of the file at src to dst, both within the
+// [Root]'s directory tree. All symlinks in src (including trailing symlinks)
+// are followed within the rootfs. The file at dst is created with the given
+// mode (the process's umask applies) if it does not exist, and is truncated
+// if it does. As with [Root.Create], a trailing symlink in dst is never
+// followed. If src and dst refer to the same file (including through
+// hardlinks), an error wrapping EINVAL is returned and the file is left
+// untouched.
+//
+// The contents are copied using copy_file_range(2) where possible, falling
+// back to a regular read-write loop otherwise. If the copy fails partway
+// through, dst is left with partial contents.
+func (r *Root) CopyFile(src, dst string, mode os.FileMode) (retErr error) {
+	srcFile, err := r.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	// dst must only be truncated once we know it isn't also src, otherwise
+	// we would truncate the source before copying it.
+	dstFile, err := r.Create(dst, os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := dstFile.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	srcInfo, err := srcFile.Stat()
+	if err != nil {
+		return fmt.Errorf("stat %s: %w", src, err)
+	}
+	dstInfo, err := dstFile.Stat()
+	if err != nil {
+		return fmt.Errorf("stat %s: %w", dst, err)
+	}
+	if os.SameFile(srcInfo, dstInfo) {
+		return &Error{
+			Errno:       unix.EINVAL,
+			Op:          "copy_file",
+			Path:        src,
+			Description: "source and destination are the same file",
+		}
+	}
+	if err := dstFile.Truncate(0); err != nil {
+		return fmt.Errorf("truncate %s: %w", dst, err)
+	}
+
+	// *os.File implements io.ReaderFrom using copy_file_range(2) (and
+	// splice(2)) with a fallback to a generic copy.
+	if _, err := io.Copy(dstFile, srcFile); err != nil {
+		return fmt.Errorf("copy %s to %s: %w", src, dst, err)
+	}
+	return nil
+}
+
+// Chmod changes the mode of the file at the given path within the [Root]'s
+// directory tree. All symlinks (including trailing symlinks) are followed
+// within the rootfs, matching the behaviour of chmod(2). Only the permission
+// and special (setuid, setgid, and sticky) bits of mode are used.
+//
+// As a safety measure, setting the setuid or setgid bits is only permitted if
+// the path resolves to a regular file or directory. Requests to set them on
+// any other kind of inode are rejected with EINVAL.
+//
+// This is effectively equivalent to [os.Chmod].
+//
+// [os.Chmod]: https://pkg.go.dev/os#Chmod
+func (r *Root) Chmod(path string, mode os.FileMode) error {
+	handle, err := r.Resolve(path)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	return chmodHandle(handle, path, mode)
+}
+
+func chmodHandle(handle *Handle, path string, mode os.FileMode) error {
+	unixMode, err := toUnixMode(mode &^ os.ModeType)
+	if err != nil {
+		return err
+	}
+	unixMode &^= unix.S_IFMT
+
+	if mode&(os.ModeSetuid|os.ModeSetgid) != 0 {
+		info, err := handle.Stat()
+		if err != nil {
+			return fmt.Errorf("stat chmod target: %w", err)
+		}
+		if !info.Mode().IsRegular() && !info.IsDir() {
+			return &Error{
+				Errno:       unix.EINVAL,
+				Op:          "chmod",
+				Path:        path,
+				Description: "refusing to set setuid or setgid bits on non-regular file",
+			}
+		}
+	}
+
+	_, err = withFileFd(handle.inner, func(fd uintptr) (struct{}, error) {
+		return withProcfsFd(fd, func(procFd uintptr, name string) (struct{}, error) {
+			if err := unix.Fchmodat(int(procFd), name, unixMode, 0); err != nil {
+				return struct{}{}, fmt.Errorf("fchmodat(/proc/thread-self/fd/%s): %w", name, err)
+			}
+			return struct{}{}, nil
+		})
+	})
+	return err
+}
+
+// LchmodIfSupported is identical to [Root.Chmod], except that trailing
+// symlinks are not followed. If the final component is a symlink, this
+// attempts to change the mode of the symlink itself using fchmodat2(2).
+//
+// Most Linux filesystems do not support changing the mode of symlinks (the
+// mode of a symlink is ignored by the kernel), and kernels older than Linux
+// 6.6 do not support fchmodat2(2). In either case, an error wrapping
+// [ErrUnsupported] (as well as the underlying errno) is returned, which can
+// be checked with [errors.Is]. If the final component is not a symlink, this
+// behaves the same as [Root.Chmod] and never returns [ErrUnsupported].
+//
+// [errors.Is]: https://pkg.go.dev/errors#Is
+func (r *Root) LchmodIfSupported(path string, mode os.FileMode) error {
+	handle, err := r.ResolveNoFollow(path)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	info, err := handle.Stat()
+	if err != nil {
+		return fmt.Errorf("stat chmod target: %w", err)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return chmodHandle(handle, path, mode)
+	}
+
+	if mode&(os.ModeSetuid|os.ModeSetgid) != 0 {
+		return &Error{
+			Errno:       unix.EINVAL,
+			Op:          "chmod",
+			Path:        path,
+			Description: "refusing to set setuid or setgid bits on non-regular file",
+		}
+	}
+	unixMode, err := toUnixMode(mode &^ os.ModeType)
+	if err != nil {
+		return err
+	}
+	unixMode &^= unix.S_IFMT
+
+	emptyPath, err := unix.BytePtrFromString("")
+	if err != nil {
+		return err
+	}
+	_, err = withFileFd(handle.inner, func(fd uintptr) (struct{}, error) {
+		_, _, errno := unix.Syscall6(unix.SYS_FCHMODAT2, fd, uintptr(unsafe.Pointer(emptyPath)),
+			uintptr(unixMode), unix.AT_EMPTY_PATH|unix.AT_SYMLINK_NOFOLLOW, 0, 0)
+		switch {
+		case errno == 0:
+			return struct{}{}, nil
+		case errors.Is(errno, unix.ENOSYS), errors.Is(errno, unix.EOPNOTSUPP):
+			return struct{}{}, fmt.Errorf("fchmodat2(AT_EMPTY_PATH) symlink %q: %w: %w", path, ErrUnsupported, errno)
+		default:
+			return struct{}{}, fmt.Errorf("fchmodat2(AT_EMPTY_PATH) symlink %q: %w", path, errno)
+		}
+	})
+	return err
+}
+
+func fchownHandle(handle *Handle, uid, gid int) error {
+	_, err := withFileFd(handle.inner, func(fd uintptr) (struct{}, error) {
+		if err := unix.Fchownat(int(fd), "", uid, gid, unix.AT_EMPTY_PATH); err != nil {
+			return struct{}{}, fmt.Errorf("fchownat(AT_EMPTY_PATH): %w", err)
+		}
+		return struct{}{}, nil
+	})
+	return err
+}
+
+// Chown changes the owner and group of the file at the given path within the
+// [Root]'s directory tree. All symlinks (including trailing symlinks) are
+// followed within the rootfs. A uid or gid of -1 means that the corresponding
+// value is not changed, as with chown(2).
+//
+// If the caller does not have the necessary privileges, the returned error
+// will wrap EPERM.
+//
+// This is effectively equivalent to [os.Chown].
+//
+// [os.Chown]: https://pkg.go.dev/os#Chown
+func (r *Root) Chown(path string, uid, gid int) error {
+	handle, err := r.Resolve(path)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	return fchownHandle(handle, uid, gid)
+}
+
+// Lchown is identical to [Root.Chown], except that trailing symlinks are not
+// followed (if the final component is a symlink, the ownership of the symlink
+// itself is changed).
+//
+// This is effectively equivalent to [os.Lchown].
+//
+// [os.Lchown]: https://pkg.go.dev/os#Lchown
+func (r *Root) Lchown(path string, uid, gid int) error {
+	handle, err := r.ResolveNoFollow(path)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	return fchownHandle(handle, uid, gid)
+}
+
+// toUtimeTimespec converts a [time.Time] to a [unix.Timespec] for
+// utimensat(2), with the zero [time.Time] mapping to UTIME_OMIT.
+func toUtimeTimespec(t time.Time) (unix.Timespec, error) {
+	if t.IsZero() {
+		return unix.Timespec{Nsec: unix.UTIME_OMIT}, nil
+	}
+	return unix.TimeToTimespec(t)
+}
+
+func utimesHandle(handle *Handle, atime, mtime time.Time) error {
+	var ts [2]unix.Timespec
+	for i, t := range []time.Time{atime, mtime} {
+		spec, err := toUtimeTimespec(t)
+		if err != nil {
+			return fmt.Errorf("convert %v to timespec: %w", t, err)
+		}
+		ts[i] = spec
+	}
+
+	_, err := withFileFd(handle.inner, func(fd uintptr) (struct{}, error) {
+		if err := unix.UtimesNanoAt(int(fd), "", ts[:], unix.AT_EMPTY_PATH); err != nil {
+			return struct{}{}, fmt.Errorf("utimensat(AT_EMPTY_PATH): %w", err)
+		}
+		return struct{}{}, nil
+	})
+	return err
+}
+
+// Chtimes changes the access and modification times of the file at the given
+// path within the [Root]'s directory tree, with nanosecond precision. All
+// symlinks (including trailing symlinks) are followed within the rootfs.
+//
+// If atime or mtime is the zero [time.Time], the corresponding timestamp is
+// left unchanged (UTIME_OMIT), allowing callers to update only one of them.
+//
+// This is effectively equivalent to [os.Chtimes].
+//
+// [os.Chtimes]: https://pkg.go.dev/os#Chtimes
+func (r *Root) Chtimes(path string, atime, mtime time.Time) error {
+	handle, err := r.Resolve(path)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	return utimesHandle(handle, atime, mtime)
+}
+
+// Lchtimes is identical to [Root.Chtimes], except that trailing symlinks are
+// not followed (if the final component is a symlink, the timestamps of the
+// symlink itself are changed).
+func (r *Root) Lchtimes(path string, atime, mtime time.Time) error {
+	handle, err := r.ResolveNoFollow(path)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	return utimesHandle(handle, atime, mtime)
+}
+
 // IntoFile unwraps the [Root] into its underlying [os.File].
 //
 // It is critical that you do not operate on this file descriptor yourself,
@@ -345,16 +2148,211 @@ func (r *Root) IntoFile() *os.File {
 	// TODO: We almost certainly want to clear r.inner here, but we can't do
 	//       that easily atomically (we could use atomic.Value but that'll make
 	//       things quite a bit uglier).
+
+	// The caller now owns the file, so we must not close it if the Root gets
+	// garbage collected.
+	runtime.SetFinalizer(r, nil)
 	return r.inner
 }
 
+// SubRoot creates a new [Root] for the directory at the given path within the
+// [Root]'s directory tree, such that operations on the new [Root] are
+// constrained to that subdirectory (even ".." components and absolute
+// symlinks cannot escape it). This is useful when handing off a subtree to
+// less-trusted code. All symlinks (including trailing symlinks) are followed
+// within the rootfs. If the path is not a directory, an error wrapping
+// ENOTDIR is returned.
+//
+// The new [Root] has its own file descriptor, so it remains usable after the
+// original [Root] is closed (and must be closed separately). The default
+// timeout set with [Root.SetDefaultTimeout] is inherited.
+func (r *Root) SubRoot(path string) (*Root, error) {
+	handle, err := r.Resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	file := handle.IntoFile()
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("stat sub-root %s: %w", path, err)
+	}
+	if !info.IsDir() {
+		_ = file.Close()
+		return nil, &Error{
+			Errno:       unix.ENOTDIR,
+			Op:          "subroot",
+			Path:        path,
+			Description: "sub-root path is not a directory",
+		}
+	}
+
+	subRoot := newRoot(file)
+	subRoot.timeout.Store(r.timeout.Load())
+	return subRoot, nil
+}
+
 // Clone creates a copy of a [Root] handle, such that it has a separate
 // lifetime to the original (while referring to the same underlying directory).
 func (r *Root) Clone() (*Root, error) {
 	return RootFromFile(r.inner)
 }
 
-// Close frees all of the resources used by the [Root] handle.
+// CloneWithCloexec is identical to [Root.Clone], except that cloexec controls
+// whether the new file descriptor is close-on-exec. All other methods
+// (including [Root.Clone]) only ever create close-on-exec file descriptors.
+//
+// Be very careful with inheritable file descriptors. A [Root] file descriptor
+// gives full access to the directory tree, and programs that inherit it are
+// not limited to paths inside it (they can simply use "..", or any symlink).
+// In a multi-threaded program (that is, any Go program) the file descriptor
+// is inherited by every program started while it is open, not just the
+// intended one. If you are starting the program with [os/exec], you should
+// use [exec.Cmd.ExtraFiles] with a [Root.Clone] instead, which only passes
+// the file descriptor to that program.
+//
+// [os/exec]: https://pkg.go.dev/os/exec
+// [exec.Cmd.ExtraFiles]: https://pkg.go.dev/os/exec#Cmd
+func (r *Root) CloneWithCloexec(cloexec bool) (*Root, error) {
+	newFile, err := dupFileCloexec(r.inner, cloexec)
+	if err != nil {
+		return nil, fmt.Errorf("duplicate root fd: %w", err)
+	}
+	return newRoot(newFile), nil
+}
+
+// Rel returns the path of the given file relative to the [Root], based on the
+// current paths of both the file and the [Root] (as given by their
+// /proc/self/fd/$n magic-links). If the file is not inside the [Root]'s
+// directory tree, an error wrapping EXDEV is returned. If the file is the
+// root directory itself, "." is returned.
+//
+// Because the path of a file can change at any time (and a file can be
+// reachable through more than one path, such as with bind-mounts), the
+// result is only informational (useful for logging, or for re-resolving the
+// file later with [Root.Resolve]). It must not be used to make security
+// decisions.
+func (r *Root) Rel(file *os.File) (string, error) {
+	rootPath, err := filePath(r.inner)
+	if err != nil {
+		return "", fmt.Errorf("get root path: %w", err)
+	}
+	path, err := filePath(file)
+	if err != nil {
+		return "", fmt.Errorf("get file path: %w", err)
+	}
+
+	rel, err := filepath.Rel(rootPath, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") || !filepath.IsAbs(path) {
+		return "", &Error{
+			Errno:       unix.EXDEV,
+			Op:          "rel",
+			Path:        path,
+			Description: "file is not inside the root",
+		}
+	}
+	return rel, nil
+}
+
+// RealPath returns the canonical path of the given path within the [Root]'s
+// directory tree (with all symlinks resolved and "." and ".." components
+// removed), relative to the [Root] but with a leading "/" (so the [Root]
+// itself is "/"). All symlinks (including trailing symlinks) are followed
+// within the rootfs.
+//
+// This is the root-relative equivalent of [filepath.EvalSymlinks]. The path is
+// resolved safely, but the returned path is taken from the resolved file (see
+// [Root.Rel]) and so the same caveats apply: the result is only informational
+// and must not be used to make security decisions.
+//
+// [filepath.EvalSymlinks]: https://pkg.go.dev/path/filepath#EvalSymlinks
+func (r *Root) RealPath(path string) (string, error) {
+	handle, err := r.Resolve(path)
+	if err != nil {
+		return "", err
+	}
+	defer handle.Close()
+
+	rel, err := r.Rel(handle.inner)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join("/", rel), nil
+}
+
+// WithFd calls fn with the [Root]'s file descriptor, to allow for operations
+// that are not wrapped by libpathrs (such as name_to_handle_at(2)). The file
+// descriptor is guaranteed to remain valid until fn returns (even if
+// [Root.Close] is called concurrently), but fn must not close it or use it
+// after returning. If the [Root] has already been closed, fn is not called
+// and an error wrapping [ErrClosed] is returned. Otherwise, the error
+// returned by fn is returned.
+//
+// Note that any operations you perform using the file descriptor do not have
+// the safety guarantees of libpathrs, so you should take care to not resolve
+// paths using it.
+func (r *Root) WithFd(fn func(fd uintptr) error) error {
+	_, err := withFileFd(r.inner, func(fd uintptr) (struct{}, error) {
+		return struct{}{}, fn(fd)
+	})
+	runtime.KeepAlive(r)
+	return err
+}
+
+// Valid returns whether the [Root] still refers to a live directory -- that
+// is, a directory that has not been deleted. This can be used by long-running
+// programs to periodically check whether a cached [Root] needs to be
+// re-opened. A directory that has been moved (but not deleted) is still
+// valid. An error is returned if the [Root] could not be checked (such as if
+// it has already been closed).
+//
+// If the directory has been deleted, Valid returns false. Such a [Root] can
+// still be used to resolve "." (allowing the directory to be inspected with
+// [Root.OpenRootHandle]), but because a directory must be empty to be
+// deleted, there is nothing else to resolve inside it, and attempts to create
+// new files in it fail with ENOENT.
+func (r *Root) Valid() (bool, error) {
+	return withFileFd(r.inner, func(fd uintptr) (bool, error) {
+		var stat unix.Stat_t
+		if err := unix.Fstat(int(fd), &stat); err != nil {
+			return false, fmt.Errorf("fstat root: %w", err)
+		}
+		return stat.Mode&unix.S_IFMT == unix.S_IFDIR && stat.Nlink > 0, nil
+	})
+}
+
+// Equal returns whether two [Root] handles refer to the same underlying
+// directory (such as a [Root] and its [Root.Clone], or two [Root]s created by
+// calling [OpenRoot] on the same directory). The comparison is done using the
+// device and inode numbers of each [Root]'s file descriptor, as with
+// [os.SameFile].
+//
+// If either [Root] has already been closed, an error is returned.
+//
+// [os.SameFile]: https://pkg.go.dev/os#SameFile
+func (r *Root) Equal(other *Root) (bool, error) {
+	info, err := r.inner.Stat()
+	if err != nil {
+		return false, fmt.Errorf("stat root: %w", err)
+	}
+	otherInfo, err := other.inner.Stat()
+	if err != nil {
+		return false, fmt.Errorf("stat other root: %w", err)
+	}
+	return os.SameFile(info, otherInfo), nil
+}
+
+// Close frees all of the resources used by the [Root] handle. Calling Close
+// more than once returns [ErrClosed]. Calling Close on a nil [Root] (such as
+// after a failed [OpenRoot]) does nothing and returns nil.
 func (r *Root) Close() error {
+	if r == nil {
+		return nil
+	}
+	if !r.closed.CompareAndSwap(false, true) {
+		return ErrClosed
+	}
+	runtime.SetFinalizer(r, nil)
 	return r.inner.Close()
 }
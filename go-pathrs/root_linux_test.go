@@ -0,0 +1,485 @@
+//go:build linux
+
+/*
+ * libpathrs: safe path resolution on Linux
+ * Copyright (C) 2019-2024 Aleksa Sarai <cyphar@cyphar.com>
+ * Copyright (C) 2019-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pathrs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/openSUSE/libpathrs/go-pathrs/pathrstest"
+)
+
+// testRoot builds the given tree in a temporary directory and returns a
+// [Root] for it, which is closed when the test finishes.
+func testRoot(t *testing.T, spec map[string]pathrstest.Entry) (*Root, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := pathrstest.BuildTree(dir, spec); err != nil {
+		t.Fatalf("build tree: %v", err)
+	}
+	root, err := OpenRoot(dir)
+	if err != nil {
+		t.Fatalf("open root: %v", err)
+	}
+	t.Cleanup(func() { _ = root.Close() })
+	return root, dir
+}
+
+func TestCopyFile(t *testing.T) {
+	root, dir := testRoot(t, map[string]pathrstest.Entry{
+		"src": {Kind: pathrstest.File, Data: []byte("contents")},
+		"dst": {Kind: pathrstest.File, Data: []byte("old contents which are longer")},
+	})
+
+	if err := root.CopyFile("src", "dst", 0o644); err != nil {
+		t.Fatalf("CopyFile: %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "dst"))
+	if err != nil || string(data) != "contents" {
+		t.Errorf("dst contents = %q, %v; want %q", data, err, "contents")
+	}
+}
+
+func TestCopyFileSameFile(t *testing.T) {
+	root, dir := testRoot(t, map[string]pathrstest.Entry{
+		"src": {Kind: pathrstest.File, Data: []byte("contents")},
+	})
+	if err := os.Link(filepath.Join(dir, "src"), filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dst := range []string{"src", "link", "./src"} {
+		err := root.CopyFile("src", dst, 0o644)
+		if !errors.Is(err, unix.EINVAL) {
+			t.Errorf("CopyFile(src, %s) = %v; want EINVAL", dst, err)
+		}
+		data, err := os.ReadFile(filepath.Join(dir, "src"))
+		if err != nil || string(data) != "contents" {
+			t.Errorf("after CopyFile(src, %s): src contents = %q, %v; want %q", dst, data, err, "contents")
+		}
+	}
+}
+
+func TestWriteFilePipe(t *testing.T) {
+	root, dir := testRoot(t, nil)
+	if err := root.Mkfifo("fifo", 0o600); err != nil {
+		t.Fatalf("Mkfifo: %v", err)
+	}
+
+	// Much larger than the pipe buffer, so the writes will be partial.
+	data := bytes.Repeat([]byte("0123456789abcdef"), 64*1024)
+	got := make(chan []byte, 1)
+	go func() {
+		defer close(got)
+		f, err := os.Open(filepath.Join(dir, "fifo"))
+		if err != nil {
+			t.Errorf("open fifo: %v", err)
+			return
+		}
+		defer f.Close()
+		buf, err := io.ReadAll(f)
+		if err != nil {
+			t.Errorf("read fifo: %v", err)
+		}
+		got <- buf
+	}()
+
+	if err := root.WriteFile("fifo", data, 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if buf := <-got; !bytes.Equal(buf, data) {
+		t.Errorf("read %d bytes from fifo; want %d", len(buf), len(data))
+	}
+}
+
+func TestRootCloseRace(t *testing.T) {
+	const (
+		rounds    = 50
+		resolvers = 8
+		closers   = 4
+	)
+
+	dir := t.TempDir()
+	if err := pathrstest.BuildTree(dir, map[string]pathrstest.Entry{
+		"a/b/c": {Kind: pathrstest.File},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < rounds; i++ {
+		root, err := OpenRoot(dir)
+		if err != nil {
+			t.Fatalf("open root: %v", err)
+		}
+
+		var (
+			wg      sync.WaitGroup
+			start   = make(chan struct{})
+			closeOK atomic.Int32
+		)
+		for j := 0; j < resolvers; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				for k := 0; k < 10; k++ {
+					handle, err := root.Resolve("a/b/c")
+					switch {
+					case err == nil:
+						_ = handle.Close()
+					case !errors.Is(err, ErrClosed):
+						t.Errorf("Resolve during Close: %v (want nil or ErrClosed)", err)
+					}
+				}
+			}()
+		}
+		for j := 0; j < closers; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				switch err := root.Close(); {
+				case err == nil:
+					closeOK.Add(1)
+				case !errors.Is(err, ErrClosed):
+					t.Errorf("concurrent Close: %v (want nil or ErrClosed)", err)
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		if n := closeOK.Load(); n != 1 {
+			t.Errorf("%d concurrent Close calls succeeded; want exactly 1", n)
+		}
+		if _, err := root.Resolve("a"); !errors.Is(err, ErrClosed) {
+			t.Errorf("Resolve after Close = %v; want ErrClosed", err)
+		}
+	}
+}
+
+func TestHandleCloseRace(t *testing.T) {
+	root, _ := testRoot(t, map[string]pathrstest.Entry{
+		"file": {Kind: pathrstest.File},
+	})
+
+	for i := 0; i < 50; i++ {
+		handle, err := root.Resolve("file")
+		if err != nil {
+			t.Fatalf("Resolve: %v", err)
+		}
+
+		var (
+			wg    sync.WaitGroup
+			start = make(chan struct{})
+		)
+		for j := 0; j < 8; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				file, err := handle.Reopen(os.O_RDONLY)
+				switch {
+				case err == nil:
+					_ = file.Close()
+				case !errors.Is(err, ErrClosed):
+					t.Errorf("Reopen during Close: %v (want nil or ErrClosed)", err)
+				}
+				if err := handle.Close(); err != nil && !errors.Is(err, ErrClosed) {
+					t.Errorf("concurrent Close: %v (want nil or ErrClosed)", err)
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		if err := handle.Close(); !errors.Is(err, ErrClosed) {
+			t.Errorf("Close after Close = %v; want ErrClosed", err)
+		}
+	}
+}
+
+func TestMkdev(t *testing.T) {
+	for _, test := range []struct {
+		major, minor uint32
+		dev          uint64
+	}{
+		{0, 0, 0},
+		{8, 1, 0x801},
+		{0xfff, 0xff, 0xfffff},
+		{0x1000, 0x100, 0x1000_0010_0000},
+		{1, 0xfffff, 0xfff0_01ff},
+		{0xffffffff, 0xffffffff, 0xffff_ffff_ffff_ffff},
+	} {
+		if dev := Mkdev(test.major, test.minor); dev != test.dev {
+			t.Errorf("Mkdev(%#x, %#x) = %#x; want %#x", test.major, test.minor, dev, test.dev)
+		}
+		if major := Major(test.dev); major != test.major {
+			t.Errorf("Major(%#x) = %#x; want %#x", test.dev, major, test.major)
+		}
+		if minor := Minor(test.dev); minor != test.minor {
+			t.Errorf("Minor(%#x) = %#x; want %#x", test.dev, minor, test.minor)
+		}
+	}
+}
+
+func TestOpenRootWithOptions(t *testing.T) {
+	dir := t.TempDir()
+	if err := pathrstest.BuildTree(dir, map[string]pathrstest.Entry{
+		"dir/file": {Kind: pathrstest.File},
+		"link":     {Kind: pathrstest.Symlink, Target: "dir"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		path    string
+		opts    []RootOption
+		timeout time.Duration
+		wantErr error
+	}{
+		{"NoOptions", "link", nil, 0, nil},
+		{"Timeout", "link", []RootOption{WithDefaultTimeout(time.Minute)}, time.Minute, nil},
+		{"NoFollowDir", "dir", []RootOption{WithNoFollowTrailing()}, 0, nil},
+		{"NoFollowSymlink", "link", []RootOption{WithNoFollowTrailing()}, 0, unix.ENOTDIR},
+		{"NoFollowThroughSymlink", "link/.", []RootOption{WithNoFollowTrailing()}, 0, nil},
+		{"NoFollowFile", "dir/file", []RootOption{WithNoFollowTrailing()}, 0, unix.ENOTDIR},
+		{"Composed", "dir", []RootOption{WithNoFollowTrailing(), WithDefaultTimeout(time.Hour)}, time.Hour, nil},
+		{"ComposedSymlink", "link", []RootOption{WithDefaultTimeout(time.Hour), WithNoFollowTrailing()}, 0, unix.ENOTDIR},
+		{"LastTimeoutWins", "dir", []RootOption{WithDefaultTimeout(time.Hour), WithDefaultTimeout(time.Second)}, time.Second, nil},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			root, err := OpenRootWithOptions(dir+"/"+test.path, test.opts...)
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Errorf("OpenRootWithOptions = %v; want %v", err, test.wantErr)
+				}
+				if root != nil {
+					_ = root.Close()
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("OpenRootWithOptions: %v", err)
+			}
+			defer root.Close()
+
+			if got := time.Duration(root.timeout.Load()); got != test.timeout {
+				t.Errorf("default timeout = %v; want %v", got, test.timeout)
+			}
+			if _, err := root.Stat("file"); err != nil {
+				t.Errorf("Stat(file) in root: %v", err)
+			}
+		})
+	}
+}
+
+// benchmarkResolvePaths builds a tree with many files and returns a [Root]
+// for it and the paths of the files.
+func benchmarkResolvePaths(b *testing.B) (*Root, []string) {
+	b.Helper()
+
+	const numPaths = 1000
+	spec := make(map[string]pathrstest.Entry, numPaths)
+	paths := make([]string, 0, numPaths)
+	for i := 0; i < numPaths; i++ {
+		path := "a/b/c/file" + strconv.Itoa(i)
+		spec[path] = pathrstest.Entry{Kind: pathrstest.File}
+		paths = append(paths, path)
+	}
+
+	dir := b.TempDir()
+	if err := pathrstest.BuildTree(dir, spec); err != nil {
+		b.Fatal(err)
+	}
+	root, err := OpenRoot(dir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() { _ = root.Close() })
+	return root, paths
+}
+
+// BenchmarkResolveLoop is the baseline for BenchmarkResolveMany.
+func BenchmarkResolveLoop(b *testing.B) {
+	root, paths := benchmarkResolvePaths(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, path := range paths {
+			handle, err := root.Resolve(path)
+			if err != nil {
+				b.Fatal(err)
+			}
+			_ = handle.Close()
+		}
+	}
+}
+
+func BenchmarkResolveMany(b *testing.B) {
+	root, paths := benchmarkResolvePaths(b)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		handles, errs := root.ResolveMany(paths)
+		for j, handle := range handles {
+			if errs[j] != nil {
+				b.Fatal(errs[j])
+			}
+			_ = handle.Close()
+		}
+	}
+}
+
+func TestNotDirError(t *testing.T) {
+	root, _ := testRoot(t, map[string]pathrstest.Entry{
+		"foo/bar": {Kind: pathrstest.File},
+		"link":    {Kind: pathrstest.Symlink, Target: "foo/bar"},
+	})
+
+	// The component walk must work the same way with a timeout, as it runs
+	// within the same deadline as the operation.
+	for _, timeout := range []time.Duration{0, time.Minute} {
+		root.SetDefaultTimeout(timeout)
+
+		for path, component := range map[string]string{
+			"foo/bar/baz":        "foo/bar",
+			"foo/bar/":           "foo/bar",
+			"/foo/./bar/baz/qux": "/foo/./bar",
+			"link/baz":           "link",
+		} {
+			_, err := root.Resolve(path)
+			var nerr *NotDirError
+			if !errors.As(err, &nerr) {
+				t.Errorf("timeout %v: Resolve(%q) = %v; want NotDirError", timeout, path, err)
+				continue
+			}
+			if nerr.Component != component {
+				t.Errorf("timeout %v: Resolve(%q) component = %q; want %q", timeout, path, nerr.Component, component)
+			}
+			if !errors.Is(err, unix.ENOTDIR) {
+				t.Errorf("timeout %v: Resolve(%q) = %v; want ENOTDIR", timeout, path, err)
+			}
+		}
+
+		// ENOTDIR caused by the final component is reported as-is.
+		err := root.RemoveDir("foo/bar")
+		var nerr *NotDirError
+		if !errors.Is(err, unix.ENOTDIR) || errors.As(err, &nerr) {
+			t.Errorf("timeout %v: RemoveDir(foo/bar) = %v; want plain ENOTDIR", timeout, err)
+		}
+	}
+}
+
+func TestMkdirAll(t *testing.T) {
+	for _, test := range []struct {
+		path, want string
+	}{
+		{"a/b/c", "a/b/c"},
+		{"../../a/d", "a/d"},
+		// ".." after a symlink goes to the parent of the symlink target, not
+		// the directory containing the symlink.
+		{"link/../e", "x/e"},
+		{"abs/f", "x/y/f"},
+		{"abs/../../g", "g"},
+	} {
+		t.Run(test.path, func(t *testing.T) {
+			root, dir := testRoot(t, map[string]pathrstest.Entry{
+				"x/y":  {Kind: pathrstest.Dir},
+				"link": {Kind: pathrstest.Symlink, Target: "x/y"},
+				"abs":  {Kind: pathrstest.Symlink, Target: "/x/y"},
+			})
+			if err := root.MkdirAll(test.path, 0o755); err != nil {
+				t.Fatalf("MkdirAll: %v", err)
+			}
+			if fi, err := os.Lstat(filepath.Join(dir, test.want)); err != nil || !fi.IsDir() {
+				t.Errorf("MkdirAll(%q) did not create %q: %v", test.path, test.want, err)
+			}
+		})
+	}
+}
+
+func TestMkdirAllErrors(t *testing.T) {
+	root, dir := testRoot(t, map[string]pathrstest.Entry{
+		"file":     {Kind: pathrstest.File},
+		"loop":     {Kind: pathrstest.Symlink, Target: "loop"},
+		"dangling": {Kind: pathrstest.Symlink, Target: "/new"},
+	})
+
+	for path, want := range map[string]error{
+		"file/a":      unix.ENOTDIR,
+		"new/../a":    unix.ENOENT,
+		"dangling":    unix.ENOTDIR,
+		"dangling/h":  unix.ENOTDIR,
+		"loop/a":      unix.ELOOP,
+		"file/../../": unix.ENOTDIR,
+	} {
+		if err := root.MkdirAll(path, 0o755); !errors.Is(err, want) {
+			t.Errorf("MkdirAll(%q) = %v; want %v", path, err, want)
+		}
+	}
+	// Neither the ".." nor the dangling symlink cases create anything.
+	if _, err := os.Lstat(filepath.Join(dir, "new")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("failed MkdirAll created new: %v", err)
+	}
+}
+
+func TestRootFromFd(t *testing.T) {
+	dir := t.TempDir()
+	for _, takeOwnership := range []bool{false, true} {
+		fd, err := unix.Open(dir, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, err := RootFromFd(uintptr(fd), takeOwnership)
+		if err != nil {
+			_ = unix.Close(fd)
+			t.Fatalf("RootFromFd(takeOwnership=%v): %v", takeOwnership, err)
+		}
+		if name := root.inner.Name(); name != dir {
+			t.Errorf("RootFromFd(takeOwnership=%v) name = %q; want %q", takeOwnership, name, dir)
+		}
+		if err := root.Close(); err != nil {
+			t.Errorf("close root: %v", err)
+		}
+
+		// The original fd is only closed with the root if it was adopted.
+		if takeOwnership {
+			if _, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0); !errors.Is(err, unix.EBADF) {
+				t.Errorf("adopted fd was not closed with the root: %v", err)
+			}
+		} else if err := unix.Close(fd); err != nil {
+			t.Errorf("borrowed fd was closed with the root: %v", err)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+//go:build linux
+
+/*
+ * libpathrs: safe path resolution on Linux
+ * Copyright (C) 2019-2024 Aleksa Sarai <cyphar@cyphar.com>
+ * Copyright (C) 2019-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pathrs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// selinuxXattr is the extended attribute used to store the SELinux label of
+// an inode.
+const selinuxXattr = "security.selinux"
+
+// selinuxfsMount is where selinuxfs is mounted when SELinux is enabled.
+const selinuxfsMount = "/sys/fs/selinux"
+
+// selinuxEnabled returns whether SELinux is enabled, using the same heuristic
+// as is_selinux_enabled(3) (whether selinuxfs is mounted).
+func selinuxEnabled() bool {
+	var st unix.Statfs_t
+	if err := unix.Statfs(selinuxfsMount, &st); err != nil {
+		return false
+	}
+	return st.Type == unix.SELINUX_MAGIC
+}
+
+// GetSELinuxLabel returns the SELinux label of the file at the given path
+// within the [Root]'s directory tree. All symlinks (including trailing
+// symlinks) are followed within the rootfs. See [Root.GetXattr] for the
+// restrictions that apply to this method.
+//
+// The label is read from the "security.selinux" extended attribute. If
+// SELinux is not enabled, the kernel does not generate labels and so this
+// returns whatever label (if any) is stored on the filesystem. If the file
+// has no label, an error wrapping ENODATA is returned.
+func (r *Root) GetSELinuxLabel(path string) (string, error) {
+	value, err := r.GetXattr(path, selinuxXattr)
+	if err != nil {
+		return "", err
+	}
+	// The kernel (and libselinux) include the trailing NUL byte.
+	return string(bytes.TrimRight(value, "\x00")), nil
+}
+
+// SetSELinuxLabel sets the SELinux label of the file at the given path within
+// the [Root]'s directory tree. All symlinks (including trailing symlinks) are
+// followed within the rootfs. See [Root.GetXattr] for the restrictions that
+// apply to this method.
+//
+// The label is written to the "security.selinux" extended attribute. If
+// SELinux is enabled, the kernel validates the label (returning an error
+// wrapping EINVAL for invalid labels) and checks that the caller is permitted
+// to relabel the file. If SELinux is not enabled, the label is stored as-is
+// without any validation, which requires CAP_SYS_ADMIN.
+func (r *Root) SetSELinuxLabel(path, label string) error {
+	return r.SetXattr(path, selinuxXattr, []byte(label), 0)
+}
+
+// withFSCreateLabel calls fn with the SELinux file creation context of the
+// current thread set to label, so that any inodes created by fn are labelled
+// atomically by the kernel. The goroutine is locked to its OS thread while fn
+// runs, and the file creation context is reset before returning.
+//
+// If the file creation context cannot be reset, the goroutine is left locked
+// to the OS thread (so that no other goroutine is scheduled on a thread that
+// would label new inodes, and the thread is terminated once the goroutine
+// exits) and the error is returned along with the result of fn.
+//
+// Note that fn must not run any operations in a different goroutine (such as
+// through [Root.SetDefaultTimeout]), as they would not use the label.
+//
+// If SELinux is not enabled, the kernel silently ignores the file creation
+// context, so an error wrapping EOPNOTSUPP is returned instead.
+func withFSCreateLabel[T any](label string, fn func() (T, error)) (T, error) {
+	if !selinuxEnabled() {
+		return *new(T), &Error{
+			Errno:       unix.EOPNOTSUPP,
+			Op:          "set_fscreate",
+			Path:        label,
+			Description: "SELinux is not enabled",
+		}
+	}
+
+	file, closer, err := ProcThreadSelfOpen("attr/fscreate", os.O_WRONLY)
+	if err != nil {
+		return *new(T), fmt.Errorf("open fscreate: %w", err)
+	}
+	defer closer()
+	defer file.Close()
+
+	return withFileFd(file, func(fd uintptr) (_ T, retErr error) {
+		if _, err := unix.Write(int(fd), []byte(label)); err != nil {
+			return *new(T), fmt.Errorf("set fscreate label %q: %w", label, err)
+		}
+		defer func() {
+			// A zero-length write resets the file creation context.
+			if _, err := unix.Write(int(fd), nil); err != nil {
+				// Balances the unlock done by closer.
+				runtime.LockOSThread()
+				if retErr == nil {
+					retErr = fmt.Errorf("reset fscreate label: %w", err)
+				}
+			}
+		}()
+		return fn()
+	})
+}
+
+// CreateWithSELinuxLabel is identical to [Root.Create], except that if the
+// file is created then it is atomically given the provided SELinux label, so
+// that it never exists without the label. Existing files are not relabelled.
+//
+// The label is applied by setting the SELinux file creation context of the
+// calling thread (as with setfscreatecon(3)) for the duration of the
+// operation. As a result, this method requires SELinux to be enabled. If it is
+// not, an error wrapping EOPNOTSUPP is returned and nothing is created -- use
+// [Root.SetSELinuxLabel] after creation if you need to support such systems.
+// The [Root]'s default timeout (see [Root.SetDefaultTimeout]) does not apply
+// to this method.
+//
+// If the file creation context cannot be reset afterwards, the calling
+// goroutine is left locked to its OS thread and an error is returned. In that
+// case the file is closed (but is not removed).
+func (r *Root) CreateWithSELinuxLabel(path string, flags int, mode os.FileMode, label string) (*os.File, error) {
+	unixMode, err := toUnixMode(mode)
+	if err != nil {
+		return nil, err
+	}
+	file, err := withFSCreateLabel(label, func() (*os.File, error) {
+		return withFileFd(r.inner, func(rootFd uintptr) (*os.File, error) {
+			handleFd, err := pathrsInRootCreat(rootFd, path, flags, unixMode)
+			if err != nil {
+				return nil, err
+			}
+			return mkFile(handleFd), nil
+		})
+	})
+	if err != nil && file != nil {
+		_ = file.Close()
+		file = nil
+	}
+	audit("creat", path, file, err)
+	return file, err
+}
+
+// MkdirWithSELinuxLabel is identical to [Root.Mkdir], except that the
+// directory is atomically given the provided SELinux label, so that it never
+// exists without the label. See [Root.CreateWithSELinuxLabel] for the
+// restrictions that apply to this method.
+func (r *Root) MkdirWithSELinuxLabel(path string, mode os.FileMode, label string) error {
+	unixMode, err := toUnixMode(mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = withFSCreateLabel(label, func() (struct{}, error) {
+		return withFileFd(r.inner, func(rootFd uintptr) (struct{}, error) {
+			err := pathrsInRootMkdir(rootFd, path, unixMode)
+			return struct{}{}, err
+		})
+	})
+	return r.mkdirError(path, err)
+}
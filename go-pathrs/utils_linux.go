@@ -21,8 +21,13 @@
 package pathrs
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"runtime"
+	"strconv"
 
 	"golang.org/x/sys/unix"
 )
@@ -82,11 +87,106 @@ func withFileFd[T any](file *os.File, fn func(fd uintptr) (T, error)) (T, error)
 	if err := conn.Control(func(fd uintptr) {
 		ret, innerErr = fn(fd)
 	}); err != nil {
-		return *new(T), err
+		// Control can only fail if the file has been closed. The file is
+		// kept alive until the callback returns, so once we are inside the
+		// callback the fd cannot be closed (and re-used) underneath us.
+		return *new(T), fmt.Errorf("%s: %w", file.Name(), ErrClosed)
 	}
 	return ret, innerErr
 }
 
+// withContext runs fn on a separate goroutine and waits for it to complete or
+// for ctx to be cancelled (whichever happens first). If ctx is cancelled first,
+// ctx.Err() is returned immediately and cleanup is called with the result of
+// fn once it eventually completes (so that any resources it allocated are not
+// leaked). fn is not run at all if ctx has already been cancelled.
+func withContext[T any](ctx context.Context, fn func() (T, error), cleanup func(T)) (T, error) {
+	if err := ctx.Err(); err != nil {
+		return *new(T), err
+	}
+	if ctx.Done() == nil {
+		// The context can never be cancelled.
+		return fn()
+	}
+
+	type result struct {
+		val T
+		err error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		val, err := fn()
+		resultCh <- result{val: val, err: err}
+	}()
+
+	select {
+	case res := <-resultCh:
+		return res.val, res.err
+	case <-ctx.Done():
+		go func() {
+			if res := <-resultCh; res.err == nil {
+				cleanup(res.val)
+			}
+		}()
+		return *new(T), ctx.Err()
+	}
+}
+
+// withProcfsFd calls fn with a (libpathrs-verified) handle to
+// /proc/thread-self/fd and the name of the magic-link for fd inside it. This
+// allows us to use *at(2) syscalls that do not support AT_EMPTY_PATH (such as
+// fchmodat(2)) on O_PATH file descriptors, without having to trust whatever
+// is mounted on /proc.
+func withProcfsFd[T any](fd uintptr, fn func(procFd uintptr, name string) (T, error)) (T, error) {
+	procFdDir, closer, err := ProcThreadSelfOpen("fd/", unix.O_PATH|unix.O_DIRECTORY)
+	if err != nil {
+		return *new(T), fmt.Errorf("open /proc/thread-self/fd: %w", err)
+	}
+	defer closer()
+	defer procFdDir.Close()
+
+	return withFileFd(procFdDir, func(procFd uintptr) (T, error) {
+		return fn(procFd, strconv.Itoa(int(fd)))
+	})
+}
+
+// withProcfsCwd is like withProcfsFd, except that fn is run with its working
+// directory set to the (libpathrs-verified) handle to /proc/thread-self/fd and
+// is only given the name of the magic-link for fd. This allows us to use
+// syscalls that only take a path (such as the *xattr(2) family and
+// inotify_add_watch(2)) on O_PATH file descriptors, with the lookup of the
+// relative name going through the verified handle rather than whatever is
+// mounted on /proc.
+//
+// Because the working directory is shared by every thread in the process, fn
+// is run in a new goroutine locked to an OS thread that has been unshared from
+// the rest of the process with unshare(CLONE_FS). The goroutine never unlocks
+// the thread, so the thread is terminated once fn returns.
+func withProcfsCwd[T any](fd uintptr, fn func(name string) (T, error)) (T, error) {
+	type result struct {
+		val T
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		runtime.LockOSThread()
+		val, err := func() (T, error) {
+			if err := unix.Unshare(unix.CLONE_FS); err != nil {
+				return *new(T), fmt.Errorf("unshare(CLONE_FS): %w", err)
+			}
+			return withProcfsFd(fd, func(procFd uintptr, name string) (T, error) {
+				if err := unix.Fchdir(int(procFd)); err != nil {
+					return *new(T), fmt.Errorf("fchdir(/proc/thread-self/fd): %w", err)
+				}
+				return fn(name)
+			})
+		}()
+		ch <- result{val: val, err: err}
+	}()
+	res := <-ch
+	return res.val, res.err
+}
+
 // dupFile makes a duplicate of the given file.
 func dupFile(file *os.File) (*os.File, error) {
 	return withFileFd(file, func(fd uintptr) (*os.File, error) {
@@ -94,18 +194,112 @@ func dupFile(file *os.File) (*os.File, error) {
 	})
 }
 
+// dupFileCloexec is like dupFile, except that whether the new file descriptor
+// is close-on-exec is controlled by cloexec.
+func dupFileCloexec(file *os.File, cloexec bool) (*os.File, error) {
+	if cloexec {
+		return dupFile(file)
+	}
+	return withFileFd(file, func(fd uintptr) (*os.File, error) {
+		newFd, err := unix.FcntlInt(fd, unix.F_DUPFD, 0)
+		if err != nil {
+			return nil, fmt.Errorf("fcntl(F_DUPFD): %w", err)
+		}
+		return os.NewFile(uintptr(newFd), file.Name()), nil
+	})
+}
+
+// writeAll writes all of data to w. While [os.File.Write] already retries
+// partial writes and EINTR, this does not rely on that: partial writes are
+// continued and EINTR is retried regardless of the writer.
+// [io.ErrShortWrite] is only returned if w makes no progress without
+// returning an error (which violates the [io.Writer] contract).
+//
+// [os.File.Write]: https://pkg.go.dev/os#File.Write
+// [io.ErrShortWrite]: https://pkg.go.dev/io#ErrShortWrite
+// [io.Writer]: https://pkg.go.dev/io#Writer
+func writeAll(w io.Writer, data []byte) error {
+	for len(data) > 0 {
+		n, err := w.Write(data)
+		if n < 0 || n > len(data) {
+			return fmt.Errorf("invalid write count %d: %w", n, io.ErrShortWrite)
+		}
+		data = data[n:]
+		switch {
+		case errors.Is(err, unix.EINTR):
+			continue
+		case err != nil:
+			return err
+		case n == 0:
+			return io.ErrShortWrite
+		}
+	}
+	return nil
+}
+
+// filePath returns the current path of the given file, as given by the
+// /proc/thread-self/fd/$n magic-link.
+func filePath(file *os.File) (string, error) {
+	return withFileFd(file, func(fd uintptr) (string, error) {
+		return ProcReadlink(ProcBaseThreadSelf, "fd/"+strconv.Itoa(int(fd)))
+	})
+}
+
+// fallbackFdName returns a placeholder name for fd, for use when the real
+// path of the file descriptor could not be determined from procfs.
+func fallbackFdName(fd uintptr) string {
+	return fmt.Sprintf("<pathrs-fd:%d>", fd)
+}
+
 // mkFile creates a new *os.File from the provided file descriptor. However,
 // unlike os.NewFile, the file's Name is based on the real path (provided by
-// /proc/self/fd/$n).
-func mkFile(fd uintptr) (*os.File, error) {
-	fdPath := fmt.Sprintf("fd/%d", fd)
-	fdName, err := ProcReadlink(ProcBaseThreadSelf, fdPath)
-	if err != nil {
-		_ = unix.Close(int(fd))
-		return nil, fmt.Errorf("failed to fetch real name of fd %d: %w", fd, err)
-	}
+// /proc/self/fd/$n). If the real path cannot be determined (such as when
+// procfs is not available), a placeholder name is used instead -- the name is
+// only informational, so this is not treated as an error.
+func mkFile(fd uintptr) *os.File {
 	// TODO: Maybe we should prefix this name with something to indicate to
 	// users that they must not use this path as a "safe" path. Something like
 	// "//pathrs-handle:/foo/bar"?
-	return os.NewFile(fd, fdName), nil
+	return os.NewFile(fd, fdName(fd))
+}
+
+// fdName returns the name to use for an [os.File] wrapping fd, which is the
+// path of fd according to /proc/thread-self/fd.
+func fdName(fd uintptr) string {
+	name, err := ProcReadlink(ProcBaseThreadSelf, fmt.Sprintf("fd/%d", fd))
+	if err != nil {
+		name = fallbackFdName(fd)
+	}
+	return name
+}
+
+// readlinkatBuf is a wrapper around readlinkat(2) which grows the provided
+// scratch buffer as needed to fit the full symlink target. The buffer can be
+// re-used by callers reading many symlinks.
+func readlinkatBuf(dirFd uintptr, path string, buf *[]byte) (string, error) {
+	if len(*buf) == 0 {
+		*buf = make([]byte, 256)
+	}
+	for {
+		n, err := unix.Readlinkat(int(dirFd), path, *buf)
+		if err != nil {
+			return "", err
+		}
+		if n < len(*buf) {
+			return string((*buf)[:n]), nil
+		}
+		*buf = make([]byte, 2*len(*buf))
+	}
+}
+
+// procFdName returns the name of fd by reading the corresponding magic-link
+// in procFd (an O_PATH handle to /proc/thread-self/fd), using buf as the
+// scratch buffer for readlinkatBuf.
+func procFdName(procFd, fd uintptr, buf *[]byte) (string, error) {
+	name := strconv.Itoa(int(fd))
+	target, err := readlinkatBuf(procFd, name, buf)
+	if err != nil {
+		return "", fmt.Errorf("readlinkat fd/%s: %w", name, err)
+	}
+	return target, nil
 }
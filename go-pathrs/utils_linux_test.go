@@ -0,0 +1,151 @@
+//go:build linux
+
+/*
+ * libpathrs: safe path resolution on Linux
+ * Copyright (C) 2019-2024 Aleksa Sarai <cyphar@cyphar.com>
+ * Copyright (C) 2019-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pathrs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/openSUSE/libpathrs/go-pathrs/pathrstest"
+)
+
+// scriptedWriter is an [io.Writer] which writes at most the given number of
+// bytes for each call to Write, returning the corresponding error.
+type scriptedWriter struct {
+	buf    bytes.Buffer
+	counts []int
+	errs   []error
+}
+
+func (w *scriptedWriter) Write(b []byte) (int, error) {
+	if len(w.counts) == 0 {
+		w.buf.Write(b)
+		return len(b), nil
+	}
+	n, err := w.counts[0], w.errs[0]
+	w.counts, w.errs = w.counts[1:], w.errs[1:]
+	if n > len(b) {
+		n = len(b)
+	}
+	w.buf.Write(b[:n])
+	return n, err
+}
+
+func TestWriteAll(t *testing.T) {
+	data := []byte("the quick brown fox jumps over the lazy dog")
+
+	for _, test := range []struct {
+		name    string
+		counts  []int
+		errs    []error
+		wantErr error
+	}{
+		{"Full", nil, nil, nil},
+		{"ShortCounts", []int{1, 2, 3, 5}, []error{nil, nil, nil, nil}, nil},
+		{"EINTR", []int{0, 0}, []error{unix.EINTR, unix.EINTR}, nil},
+		{"EINTRWithProgress", []int{4, 7, 0}, []error{unix.EINTR, nil, unix.EINTR}, nil},
+		{"NoProgress", []int{3, 0}, []error{nil, nil}, io.ErrShortWrite},
+		{"Error", []int{3, 2}, []error{nil, unix.EIO}, unix.EIO},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			w := &scriptedWriter{counts: test.counts, errs: test.errs}
+			err := writeAll(w, data)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("writeAll = %v; want %v", err, test.wantErr)
+			}
+			if err == nil && !bytes.Equal(w.buf.Bytes(), data) {
+				t.Errorf("wrote %q; want %q", w.buf.Bytes(), data)
+			}
+		})
+	}
+}
+
+func TestMkFileName(t *testing.T) {
+	root, dir := testRoot(t, map[string]pathrstest.Entry{
+		"a/b":  {Kind: pathrstest.Dir},
+		"link": {Kind: pathrstest.Symlink, Target: "/a/b"},
+	})
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handle, err := root.Resolve("link")
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	defer handle.Close()
+	if got, want := handle.Name(), filepath.Join(realDir, "a/b"); got != want {
+		t.Errorf("resolved handle name = %q; want %q", got, want)
+	}
+
+	file, err := root.Create("link/file", os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	defer file.Close()
+	if got, want := file.Name(), filepath.Join(realDir, "a/b/file"); got != want {
+		t.Errorf("created file name = %q; want %q", got, want)
+	}
+}
+
+func TestMkFileFallbackName(t *testing.T) {
+	// Find an unused file descriptor number. Because new file descriptors
+	// always use the lowest free number, nothing else will allocate a number
+	// this large while the test is running.
+	fd := -1
+	for n := 900; n < 1000; n++ {
+		if _, err := unix.FcntlInt(uintptr(n), unix.F_GETFD, 0); errors.Is(err, unix.EBADF) {
+			fd = n
+			break
+		}
+	}
+	if fd < 0 {
+		t.Skip("could not find an unused file descriptor number")
+	}
+
+	// With no open file, the /proc/thread-self/fd magic-link doesn't exist
+	// and so a placeholder name must be used.
+	file := mkFile(uintptr(fd))
+	if got, want := file.Name(), "<pathrs-fd:"+strconv.Itoa(fd)+">"; got != want {
+		t.Errorf("fallback name = %q; want %q", got, want)
+	}
+
+	// Make sure the *os.File owns a real file descriptor before closing it.
+	nullFd, err := unix.Open("/dev/null", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(nullFd)
+	if err := unix.Dup3(nullFd, fd, unix.O_CLOEXEC); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+}
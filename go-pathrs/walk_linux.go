@@ -0,0 +1,259 @@
+//go:build linux
+
+/*
+ * libpathrs: safe path resolution on Linux
+ * Copyright (C) 2019-2024 Aleksa Sarai <cyphar@cyphar.com>
+ * Copyright (C) 2019-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pathrs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/sys/unix"
+)
+
+// openSubdir opens the directory entry name inside dir. Only the single
+// component is looked up (with O_NOFOLLOW), so if the entry was swapped for a
+// symlink after dir was read, an error is returned rather than following it.
+func openSubdir(dir *os.File, name string) (*os.File, error) {
+	return withFileFd(dir, func(dirFd uintptr) (*os.File, error) {
+		fd, err := unix.Openat(int(dirFd), name, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return nil, &os.PathError{Op: "openat", Path: filepath.Join(dir.Name(), name), Err: err}
+		}
+		return os.NewFile(uintptr(fd), filepath.Join(dir.Name(), name)), nil
+	})
+}
+
+// readDirSorted reads all of the entries of dir, sorted by filename.
+func readDirSorted(dir *os.File) ([]fs.DirEntry, error) {
+	entries, err := dir.ReadDir(-1)
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+	return entries, err
+}
+
+// walkDir recursively descends path (which is the directory entry d, opened
+// as dir if it is a directory), calling fn for each entry. The semantics
+// match those of filepath.WalkDir.
+//
+//nolint:cyclop // this function needs to handle all of the WalkDir cases
+func walkDir(dir *os.File, path string, d fs.DirEntry, fn fs.WalkDirFunc) error {
+	if err := fn(path, d, nil); err != nil || !d.IsDir() {
+		if errors.Is(err, fs.SkipDir) && d.IsDir() {
+			err = nil
+		}
+		return err
+	}
+
+	entries, err := readDirSorted(dir)
+	if err != nil {
+		// Second call, to report the ReadDir error.
+		if err := fn(path, d, err); err != nil {
+			if errors.Is(err, fs.SkipDir) {
+				err = nil
+			}
+			return err
+		}
+	}
+
+	for _, entry := range entries {
+		name := filepath.Join(path, entry.Name())
+		if !entry.IsDir() {
+			if err := walkDir(nil, name, entry, fn); err != nil {
+				if errors.Is(err, fs.SkipDir) {
+					break
+				}
+				return err
+			}
+			continue
+		}
+
+		subdir, err := openSubdir(dir, entry.Name())
+		if err != nil {
+			// Match filepath.WalkDir by first reporting the directory and then
+			// reporting the error from trying to read it.
+			if err := fn(name, entry, nil); err != nil {
+				if errors.Is(err, fs.SkipDir) {
+					continue
+				}
+				return err
+			}
+			if err := fn(name, entry, err); err != nil {
+				if errors.Is(err, fs.SkipDir) {
+					continue
+				}
+				return err
+			}
+			continue
+		}
+		err = walkDir(subdir, name, entry, fn)
+		_ = subdir.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WalkDir walks the file tree rooted at root (a path within the [Root]'s
+// directory tree), calling fn for each file or directory in the tree
+// (including root itself). The semantics are identical to [filepath.WalkDir]
+// (including support for [fs.SkipDir] and [fs.SkipAll], and errors when
+// reading a directory being passed to fn), and the paths passed to fn are
+// root joined with the path of the entry relative to root.
+//
+// Symlinks are never followed (except for symlinks in root itself, which are
+// resolved within the [Root] -- a trailing symlink in root is not followed).
+// Each directory is opened relative to its already-opened parent using only
+// its own name (with O_NOFOLLOW), so if an attacker swaps a subdirectory with
+// a symlink after it has been listed, fn will be called with an error for
+// that entry rather than WalkDir escaping the directory tree being walked.
+//
+// [filepath.WalkDir]: https://pkg.go.dev/path/filepath#WalkDir
+// [fs.SkipDir]: https://pkg.go.dev/io/fs#SkipDir
+// [fs.SkipAll]: https://pkg.go.dev/io/fs#SkipAll
+func (r *Root) WalkDir(root string, fn fs.WalkDirFunc) error {
+	err := r.walkRoot(root, fn)
+	if errors.Is(err, fs.SkipDir) || errors.Is(err, fs.SkipAll) {
+		err = nil
+	}
+	return err
+}
+
+func (r *Root) walkRoot(root string, fn fs.WalkDirFunc) error {
+	handle, err := r.ResolveNoFollow(root)
+	if err != nil {
+		return fn(root, nil, err)
+	}
+	defer handle.Close()
+
+	info, err := handle.Stat()
+	if err != nil {
+		return fn(root, nil, err)
+	}
+	entry := fs.FileInfoToDirEntry(info)
+	if !entry.IsDir() {
+		return walkDir(nil, root, entry, fn)
+	}
+
+	dir, err := handle.Reopen(os.O_RDONLY | unix.O_DIRECTORY)
+	if err != nil {
+		if err := fn(root, entry, nil); err != nil {
+			return err
+		}
+		return fn(root, entry, err)
+	}
+	defer dir.Close()
+
+	return walkDir(dir, root, entry, fn)
+}
+
+// openEntryHandle opens the directory entry name inside dir as an O_PATH
+// [Handle]. As with openSubdir, only the single component is looked up (with
+// O_NOFOLLOW), so symlinks are never followed.
+func openEntryHandle(dir *os.File, name string) (*Handle, error) {
+	return withFileFd(dir, func(dirFd uintptr) (*Handle, error) {
+		fd, err := unix.Openat(int(dirFd), name, unix.O_PATH|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return nil, &os.PathError{Op: "openat", Path: filepath.Join(dir.Name(), name), Err: err}
+		}
+		return newHandle(os.NewFile(uintptr(fd), filepath.Join(dir.Name(), name))), nil
+	})
+}
+
+// walkHandles is the equivalent of walkDir for [Root.WalkHandles]. The
+// [Handle] h is owned by the caller.
+func walkHandles(h *Handle, path string, d fs.DirEntry, fn func(path string, h *Handle, d fs.DirEntry) error) error {
+	if err := fn(path, h, d); err != nil || !d.IsDir() {
+		if errors.Is(err, fs.SkipDir) && d.IsDir() {
+			err = nil
+		}
+		return err
+	}
+
+	dir, err := h.Reopen(os.O_RDONLY | unix.O_DIRECTORY)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	entries, err := readDirSorted(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		child, err := openEntryHandle(dir, entry.Name())
+		if err != nil {
+			return err
+		}
+		err = walkHandles(child, filepath.Join(path, entry.Name()), entry, fn)
+		_ = child.Close()
+		if err != nil {
+			if errors.Is(err, fs.SkipDir) && !entry.IsDir() {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// WalkHandles is like [Root.WalkDir], except that fn is also given an
+// already-opened [Handle] to each entry, so that operations on the entries
+// (such as [Handle.Reopen] or [Handle.Stat]) do not need to re-resolve each
+// path from the top of the [Root]. The same protections against symlinks and
+// concurrent renames as [Root.WalkDir] apply, and each [Handle] is opened with
+// O_PATH|O_NOFOLLOW relative to its (already-opened) parent directory.
+//
+// The [Handle]s are owned by WalkHandles: fn must not close them, and they are
+// closed once fn returns (or, for directories, once the contents of the
+// directory have been walked). Use [Handle.Clone] if you need a [Handle] to
+// outlive the call to fn. At most one [Handle] (and one open directory) per
+// level of the tree is open at any time.
+//
+// Unlike [Root.WalkDir], fn is not called with errors: if an entry cannot be
+// opened or a directory cannot be read, the walk is stopped and the error is
+// returned. [fs.SkipDir] and [fs.SkipAll] are supported with the same
+// semantics as with [Root.WalkDir].
+//
+// [fs.SkipDir]: https://pkg.go.dev/io/fs#SkipDir
+// [fs.SkipAll]: https://pkg.go.dev/io/fs#SkipAll
+func (r *Root) WalkHandles(root string, fn func(path string, h *Handle, d fs.DirEntry) error) error {
+	handle, err := r.ResolveNoFollow(root)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	info, err := handle.Stat()
+	if err != nil {
+		return err
+	}
+
+	err = walkHandles(handle, root, fs.FileInfoToDirEntry(info), fn)
+	if errors.Is(err, fs.SkipDir) || errors.Is(err, fs.SkipAll) {
+		err = nil
+	}
+	return err
+}
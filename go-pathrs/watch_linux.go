@@ -0,0 +1,198 @@
+//go:build linux
+
+/*
+ * libpathrs: safe path resolution on Linux
+ * Copyright (C) 2019-2024 Aleksa Sarai <cyphar@cyphar.com>
+ * Copyright (C) 2019-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pathrs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// inotifyBufferSize is large enough to read several events (each with a
+// maximum-length name) in a single read(2).
+const inotifyBufferSize = 16 * (unix.SizeofInotifyEvent + unix.NAME_MAX + 1)
+
+// WatchEvent is an inotify(7) event returned by a [Watcher].
+type WatchEvent struct {
+	// Name is the name of the entry (within the watched directory) that the
+	// event refers to. It is empty for events about the watched inode itself.
+	Name string
+	// Mask is the set of IN_* flags describing the event.
+	Mask uint32
+	// Cookie is used to connect related IN_MOVED_FROM and IN_MOVED_TO events.
+	Cookie uint32
+}
+
+// Watcher is an inotify(7) watch on an inode within a [Root], created with
+// [Root.Watch]. Each Watcher has its own inotify instance, and the watch is
+// removed when the Watcher is closed with [Watcher.Close].
+type Watcher struct {
+	inotify *os.File
+	events  chan WatchEvent
+	done    chan struct{}
+	exited  chan struct{}
+	closed  atomic.Bool
+
+	errMu sync.Mutex
+	err   error
+}
+
+// Watch adds an inotify(7) watch for the events in mask (the IN_* flags to
+// inotify_add_watch(2)) on the file or directory at the given path within the
+// [Root]'s directory tree, and returns a [Watcher] that delivers the events.
+// All symlinks (including trailing symlinks) are followed within the rootfs,
+// so IN_DONT_FOLLOW is not supported (and results in an error wrapping
+// EINVAL).
+//
+// Because inotify_add_watch(2) only accepts a path, the watch is added through
+// the magic-link for the resolved [Handle]. The magic-link is looked up
+// relative to a libpathrs-verified handle to /proc/thread-self/fd (from a
+// short-lived thread whose working directory is that handle), so that a bogus
+// /proc mount cannot be used to redirect the watch.
+//
+// The watch refers to the inode rather than the path, so it is not affected
+// by later renames of the path (and if the inode is deleted, an IN_IGNORED
+// event is delivered and no further events will arrive).
+func (r *Root) Watch(path string, mask uint32) (*Watcher, error) {
+	if mask&unix.IN_DONT_FOLLOW != 0 {
+		return nil, &Error{
+			Errno:       unix.EINVAL,
+			Op:          "watch",
+			Path:        path,
+			Description: "IN_DONT_FOLLOW is not supported",
+		}
+	}
+
+	handle, err := r.Resolve(path)
+	if err != nil {
+		return nil, err
+	}
+	defer handle.Close()
+
+	inotifyFd, err := unix.InotifyInit1(unix.IN_NONBLOCK | unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("inotify_init1: %w", err)
+	}
+	// The inotify file descriptor is non-blocking, so the runtime poller is
+	// used for reads and Close will interrupt a blocked read.
+	inotify := os.NewFile(uintptr(inotifyFd), "inotify:"+path)
+
+	_, err = withFileFd(handle.inner, func(fd uintptr) (struct{}, error) {
+		// inotify_add_watch(2) only takes a path, so we look up the
+		// magic-link relative to our (libpathrs-verified) handle to
+		// /proc/thread-self/fd rather than using /proc/self/fd/$n, which
+		// would trust whatever is mounted on /proc.
+		return withProcfsCwd(fd, func(name string) (struct{}, error) {
+			if _, err := unix.InotifyAddWatch(inotifyFd, name, mask); err != nil {
+				return struct{}{}, fmt.Errorf("inotify_add_watch %s: %w", path, err)
+			}
+			return struct{}{}, nil
+		})
+	})
+	if err != nil {
+		_ = inotify.Close()
+		return nil, err
+	}
+
+	w := &Watcher{
+		inotify: inotify,
+		events:  make(chan WatchEvent),
+		done:    make(chan struct{}),
+		exited:  make(chan struct{}),
+	}
+	go w.readEvents()
+	return w, nil
+}
+
+// readEvents reads events from the inotify instance and sends them to the
+// events channel until the [Watcher] is closed or reading fails.
+func (w *Watcher) readEvents() {
+	defer close(w.exited)
+	defer close(w.events)
+
+	buf := make([]byte, inotifyBufferSize)
+	for {
+		n, err := w.inotify.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				w.errMu.Lock()
+				w.err = fmt.Errorf("read inotify events: %w", err)
+				w.errMu.Unlock()
+			}
+			return
+		}
+
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			raw := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + unix.SizeofInotifyEvent
+			nameEnd := nameStart + int(raw.Len)
+			if nameEnd > n {
+				break
+			}
+			event := WatchEvent{
+				Name:   string(bytes.TrimRight(buf[nameStart:nameEnd], "\x00")),
+				Mask:   raw.Mask,
+				Cookie: raw.Cookie,
+			}
+			offset = nameEnd
+
+			select {
+			case w.events <- event:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
+
+// Events returns the channel that events are delivered on. The channel is
+// closed once the [Watcher] is closed, or if reading events fails (in which
+// case [Watcher.Err] returns the error).
+func (w *Watcher) Events() <-chan WatchEvent {
+	return w.events
+}
+
+// Err returns the error that caused the events channel to be closed, or nil
+// if the [Watcher] is still running or was closed with [Watcher.Close].
+func (w *Watcher) Err() error {
+	w.errMu.Lock()
+	defer w.errMu.Unlock()
+	return w.err
+}
+
+// Close removes the watch and releases the inotify instance, and waits for
+// the events channel to be closed. Any events that have not yet been received
+// are discarded. Calling Close more than once returns [ErrClosed].
+func (w *Watcher) Close() error {
+	if !w.closed.CompareAndSwap(false, true) {
+		return ErrClosed
+	}
+	close(w.done)
+	err := w.inotify.Close()
+	<-w.exited
+	return err
+}
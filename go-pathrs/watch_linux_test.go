@@ -0,0 +1,77 @@
+//go:build linux
+
+/*
+ * libpathrs: safe path resolution on Linux
+ * Copyright (C) 2019-2024 Aleksa Sarai <cyphar@cyphar.com>
+ * Copyright (C) 2019-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pathrs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/openSUSE/libpathrs/go-pathrs/pathrstest"
+)
+
+func TestWatch(t *testing.T) {
+	root, dir := testRoot(t, map[string]pathrstest.Entry{
+		"dir":  {Kind: pathrstest.Dir},
+		"link": {Kind: pathrstest.Symlink, Target: "/dir"},
+	})
+
+	w, err := root.Watch("link", unix.IN_CREATE)
+	if err != nil {
+		t.Fatalf("Watch: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "dir", "new"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-w.Events():
+		if event.Name != "new" || event.Mask&unix.IN_CREATE == 0 {
+			t.Errorf("unexpected event %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, ok := <-w.Events(); ok {
+		t.Error("events channel still open after Close")
+	}
+	if err := w.Close(); !errors.Is(err, ErrClosed) {
+		t.Errorf("second Close = %v; want ErrClosed", err)
+	}
+}
+
+func TestWatchNoFollow(t *testing.T) {
+	root, _ := testRoot(t, map[string]pathrstest.Entry{
+		"dir": {Kind: pathrstest.Dir},
+	})
+
+	_, err := root.Watch("dir", unix.IN_CREATE|unix.IN_DONT_FOLLOW)
+	if !errors.Is(err, unix.EINVAL) {
+		t.Errorf("Watch with IN_DONT_FOLLOW = %v; want EINVAL", err)
+	}
+}
@@ -0,0 +1,170 @@
+//go:build linux
+
+/*
+ * libpathrs: safe path resolution on Linux
+ * Copyright (C) 2019-2024 Aleksa Sarai <cyphar@cyphar.com>
+ * Copyright (C) 2019-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pathrs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// withXattrPath resolves path within the [Root] and calls fn with a relative
+// path that can be used with the path-based *xattr(2) family of syscalls to
+// operate on the resolved file.
+//
+// Unfortunately, f*xattr(2) do not work on O_PATH file descriptors and there
+// are no *xattrat(2) syscalls on most kernels. Rather than re-opening the
+// handle (which would require read access and would actually open device
+// nodes), fn is run with its working directory set to a libpathrs-verified
+// handle to /proc/thread-self/fd (see withProcfsCwd) and given the name of
+// the magic-link for the handle.
+func (r *Root) withXattrPath(path string, fn func(xattrPath string) error) error {
+	handle, err := r.Resolve(path)
+	if err != nil {
+		return err
+	}
+	defer handle.Close()
+
+	_, err = withFileFd(handle.inner, func(fd uintptr) (struct{}, error) {
+		return withProcfsCwd(fd, func(name string) (struct{}, error) {
+			return struct{}{}, fn(name)
+		})
+	})
+	return err
+}
+
+// xattrBuffer implements the "size probe" pattern for f*xattr calls, calling
+// fn with a nil buffer to get the required size and then retrying with a
+// correctly-sized buffer until the value fits (the value may grow between
+// calls).
+func xattrBuffer(fn func(buf []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := fn(nil)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size)
+		n, err := fn(buf)
+		switch {
+		case errors.Is(err, unix.ERANGE):
+			continue
+		case err != nil:
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+// GetXattr returns the value of the extended attribute name of the file at
+// the given path within the [Root]'s directory tree. All symlinks (including
+// trailing symlinks) are followed within the rootfs. The value is returned
+// byte-for-byte, and need not be valid UTF-8.
+//
+// Because f*xattr(2) cannot be used on O_PATH file descriptors, extended
+// attributes are accessed through the /proc/thread-self/fd magic-link of
+// the resolved file. The magic-link is looked up relative to a
+// libpathrs-verified handle to procfs (from a short-lived thread whose working
+// directory is that handle), so a bogus /proc mount cannot be used to redirect
+// the operation. The file is never opened, so read access to it is not
+// required (and device nodes are not opened), but the *Xattr methods cannot be
+// used to operate on symlinks.
+//
+// This is effectively equivalent to [unix.Getxattr].
+//
+// [unix.Getxattr]: https://pkg.go.dev/golang.org/x/sys/unix#Getxattr
+func (r *Root) GetXattr(path, name string) ([]byte, error) {
+	var value []byte
+	err := r.withXattrPath(path, func(xattrPath string) error {
+		var err error
+		value, err = xattrBuffer(func(buf []byte) (int, error) {
+			return unix.Getxattr(xattrPath, name, buf)
+		})
+		if err != nil {
+			return fmt.Errorf("getxattr(%q): %w", name, err)
+		}
+		return nil
+	})
+	return value, err
+}
+
+// SetXattr sets the value of the extended attribute name of the file at the
+// given path within the [Root]'s directory tree. All symlinks (including
+// trailing symlinks) are followed within the rootfs. The flags argument is
+// identical to the XATTR_* flags to the setxattr(2) system call. See
+// [Root.GetXattr] for the restrictions that apply to this method.
+//
+// This is effectively equivalent to [unix.Setxattr].
+//
+// [unix.Setxattr]: https://pkg.go.dev/golang.org/x/sys/unix#Setxattr
+func (r *Root) SetXattr(path, name string, value []byte, flags int) error {
+	return r.withXattrPath(path, func(xattrPath string) error {
+		if err := unix.Setxattr(xattrPath, name, value, flags); err != nil {
+			return fmt.Errorf("setxattr(%q): %w", name, err)
+		}
+		return nil
+	})
+}
+
+// ListXattr returns the names of all extended attributes of the file at the
+// given path within the [Root]'s directory tree. All symlinks (including
+// trailing symlinks) are followed within the rootfs. See [Root.GetXattr] for
+// the restrictions that apply to this method.
+//
+// This is effectively equivalent to [unix.Listxattr].
+//
+// [unix.Listxattr]: https://pkg.go.dev/golang.org/x/sys/unix#Listxattr
+func (r *Root) ListXattr(path string) ([]string, error) {
+	var names []string
+	err := r.withXattrPath(path, func(xattrPath string) error {
+		buf, err := xattrBuffer(func(buf []byte) (int, error) {
+			return unix.Listxattr(xattrPath, buf)
+		})
+		if err != nil {
+			return fmt.Errorf("listxattr: %w", err)
+		}
+		for _, name := range bytes.Split(buf, []byte{0}) {
+			if len(name) > 0 {
+				names = append(names, string(name))
+			}
+		}
+		return nil
+	})
+	return names, err
+}
+
+// RemoveXattr removes the extended attribute name from the file at the given
+// path within the [Root]'s directory tree. All symlinks (including trailing
+// symlinks) are followed within the rootfs. See [Root.GetXattr] for the
+// restrictions that apply to this method.
+//
+// This is effectively equivalent to [unix.Removexattr].
+//
+// [unix.Removexattr]: https://pkg.go.dev/golang.org/x/sys/unix#Removexattr
+func (r *Root) RemoveXattr(path, name string) error {
+	return r.withXattrPath(path, func(xattrPath string) error {
+		if err := unix.Removexattr(xattrPath, name); err != nil {
+			return fmt.Errorf("removexattr(%q): %w", name, err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,79 @@
+//go:build linux
+
+/*
+ * libpathrs: safe path resolution on Linux
+ * Copyright (C) 2019-2024 Aleksa Sarai <cyphar@cyphar.com>
+ * Copyright (C) 2019-2024 SUSE LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *    http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pathrs
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/openSUSE/libpathrs/go-pathrs/pathrstest"
+)
+
+func TestXattr(t *testing.T) {
+	root, _ := testRoot(t, map[string]pathrstest.Entry{
+		// The file is unreadable, which is fine because it is never opened.
+		"file": {Kind: pathrstest.File, Mode: 0o200},
+		"link": {Kind: pathrstest.Symlink, Target: "/file"},
+	})
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The magic-link lookup happens on a separate thread, so it must not
+	// change the working directory of the rest of the process.
+	defer func() {
+		if got, err := os.Getwd(); err != nil || got != wd {
+			t.Errorf("working directory changed to %q (%v); want %q", got, err, wd)
+		}
+	}()
+
+	const name = "user.pathrs-test"
+	err = root.SetXattr("link", name, []byte("value"), 0)
+	if errors.Is(err, unix.ENOTSUP) {
+		t.Skipf("user xattrs not supported: %v", err)
+	}
+	if err != nil {
+		t.Fatalf("SetXattr: %v", err)
+	}
+
+	value, err := root.GetXattr("file", name)
+	if err != nil || string(value) != "value" {
+		t.Errorf("GetXattr = %q, %v; want %q", value, err, "value")
+	}
+	names, err := root.ListXattr("file")
+	found := false
+	for _, got := range names {
+		found = found || got == name
+	}
+	if err != nil || !found {
+		t.Errorf("ListXattr = %q, %v; want it to contain %q", names, err, name)
+	}
+	if err := root.RemoveXattr("file", name); err != nil {
+		t.Errorf("RemoveXattr: %v", err)
+	}
+	if _, err := root.GetXattr("file", name); !errors.Is(err, unix.ENODATA) {
+		t.Errorf("GetXattr after RemoveXattr = %v; want ENODATA", err)
+	}
+}